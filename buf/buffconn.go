@@ -39,3 +39,8 @@ func (b *BufferedConn) SetReadDeadline(t time.Time) error {
 func (b *BufferedConn) SetWriteDeadline(t time.Time) error {
 	return b.conn.SetWriteDeadline(t)
 }
+
+// NetConn returns the wrapped connection.
+func (b *BufferedConn) NetConn() net.Conn {
+	return b.conn
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/proxy"
+)
+
+const caUsage = `usage: mitm-proxy ca init [flags]
+
+Generates a CA certificate and key for the proxy and writes them to the
+output directory as ca.pem, ca-key.pem, ca.der and ca.p12.
+`
+
+// runCA runs the "ca" subcommand.
+func runCA(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		fmt.Fprint(os.Stderr, caUsage)
+		return errors.New("unknown ca command")
+	}
+
+	fs := flag.NewFlagSet("ca init", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), caUsage+"\n")
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "MITM Proxy CA", "common name of the CA")
+	keyType := fs.String("keytype", "ecdsa", "key type: ecdsa, ecdsa-p384, rsa, rsa-3072 or rsa-4096")
+	days := fs.Int("days", 3650, "number of days the CA is valid")
+	outDir := fs.String("out", ".", "output directory")
+	p12Password := fs.String("p12password", "", "password protecting the PKCS#12 file")
+	p12Modern := fs.Bool("p12modern", false, "encrypt the PKCS#12 file with AES-256 instead of 3DES, which older keychains and OpenSSL can't read")
+	force := fs.Bool("force", false, "overwrite existing files")
+	fs.Parse(args[1:])
+
+	ca, err := proxy.GenerateCA(*name, *keyType, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+
+	p12, err := ca.PKCS12(*p12Password, *p12Modern)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{"ca.pem", ca.CertPEM(), 0o644},
+		{"ca-key.pem", keyPEM, 0o600},
+		{"ca.der", ca.CertDER(), 0o644},
+		{"ca.p12", p12, 0o600},
+	}
+
+	if !*force {
+		for _, f := range files {
+			path := filepath.Join(*outDir, f.name)
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite", path)
+			}
+		}
+	}
+
+	if err = os.MkdirAll(*outDir, 0o755); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(*outDir, f.name)
+		if err = os.WriteFile(path, f.data, f.perm); err != nil {
+			return err
+		}
+		slog.Info("Wrote", slog.String("file", path))
+	}
+
+	return nil
+}
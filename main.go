@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"io"
 	"log/slog"
@@ -17,13 +18,38 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := runCA(os.Args[2:]); err != nil {
+			slog.Error("Error running ca command", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	addr := flag.String("addr", "127.0.0.1:9999", "proxy address")
 	caCertFile := flag.String("cacertfile", "", "certificate .pem file for trusted CA")
-	caKeyFile := flag.String("cakeyfile", "", "key .pem file for trusted CA")
+	caKeyFile := flag.String("cakeyfile", "", "key .pem file for trusted CA, defaults to the key in -cacertfile")
 	debug := flag.Bool("debug", false, "enable debug logging")
 	rulesDir := flag.String("rulesdir", "proxy_rules", "directory for rules")
 	envFile := flag.String("env", "", "environment file")
+	configFile := flag.String("config", "", "proxy configuration file")
 	testRules := flag.Bool("test", false, "test rules")
+	protoset := flag.String("protoset", "", "protobuf descriptor set file used to decode gRPC messages")
+	transparentAddr := flag.String("transparentaddr", "", "transparent proxy address for iptables redirected traffic")
+	tproxy := flag.Bool("tproxy", false, "use TPROXY instead of REDIRECT semantics for the transparent listener")
+	socksAddr := flag.String("socksaddr", "", "SOCKS5 proxy address")
+	socksUser := flag.String("socksuser", "", "username required from SOCKS5 clients")
+	socksPassword := flag.String("sockspass", "", "password required from SOCKS5 clients")
+	upstreamProxy := flag.String("upstreamproxy", "", "upstream proxy url (http://, https://, socks5://)")
+	upstreamBypass := flag.String("upstreambypass", "", "comma separated hosts, globs or CIDRs to dial directly")
+	certCacheSize := flag.Int("certcachesize", 10000, "maximum number of forged certificates kept in memory")
+	certCacheDir := flag.String("certcachedir", "", "directory to persist forged certificates across restarts")
+	certDir := flag.String("certdir", "", "directory of certificates presented instead of forged ones for the hosts they cover")
+	magicHost := flag.String("magichost", proxy.DefaultMagicHost, "host answered by the proxy with the CA certificate and a PAC file, empty to disable")
+	mirrorCerts := flag.Bool("mirrorcerts", false, "copy SANs and subject of the upstream certificate into forged certificates")
+	keyLogFile := flag.String("keylogfile", os.Getenv("SSLKEYLOGFILE"), "file to append TLS secrets to in NSS key log format, defaults to $SSLKEYLOGFILE")
+	pcapDir := flag.String("pcapdir", "", "directory to write the decrypted HTTP exchanges of each intercepted connection to as pcapng")
+	tlsFingerprint := flag.String("tlsfingerprint", "", "ClientHello sent to origin servers: go, client to replay the client's, or chrome, firefox, safari, edge, ios, android")
 	flag.Parse()
 
 	if *debug {
@@ -45,6 +71,14 @@ func main() {
 		slog.Debug("Error parsing environment variables", slog.String("err", err.Error()))
 	}
 
+	if *protoset != "" {
+		err = rule.LoadDescriptorSet(*protoset)
+		if err != nil {
+			slog.Error("Error loading descriptor set", slog.String("err", err.Error()))
+			return
+		}
+	}
+
 	requestRules, responseRules, err := rule.CompileRules(*rulesDir, envs)
 	if err != nil {
 		slog.Error("Error compiling rules", slog.String("err", err.Error()))
@@ -77,31 +111,95 @@ func main() {
 				continue
 			}
 
-			err = r.Apply(request, nil)
-			if err != nil {
-				slog.Error("Error applying request rule", slog.String("rule", r.Name), slog.String("err", err.Error()))
-				continue
-			}
+			logTestResult("request", r, r.Apply(request, nil))
 		}
 
 		for _, r := range responseRules {
 			_, err := r.Check(request, response)
 			if err != nil {
-				slog.Error("Error checking request rule", slog.String("rule", r.Name), slog.String("err", err.Error()))
+				slog.Error("Error checking response rule", slog.String("rule", r.Name), slog.String("err", err.Error()))
 				continue
 			}
 
-			err = r.Apply(request, response)
-			if err != nil {
-				slog.Error("Error applying response rule", slog.String("rule", r.Name), slog.String("err", err.Error()))
-				continue
-			}
+			logTestResult("response", r, r.Apply(request, response))
 		}
 
 		return
 	}
 
-	proxySSl := proxy.NewProxySslServer(*caCertFile, *caKeyFile, requestRules, responseRules)
+	var opts []proxy.Option
+	if *configFile != "" {
+		cfg, err := proxy.LoadConfig(*configFile, envs)
+		if err != nil {
+			slog.Error("Error loading config", slog.String("file", *configFile), slog.String("err", err.Error()))
+			return
+		}
+		opts = append(opts, proxy.WithConfig(cfg))
+	}
+	if *upstreamProxy != "" {
+		dialer, err := proxy.NewUpstreamDialer(*upstreamProxy, strings.Split(*upstreamBypass, ","))
+		if err != nil {
+			slog.Error("Error configuring upstream proxy", slog.String("err", err.Error()))
+			return
+		}
+		opts = append(opts, proxy.WithDialer(dialer))
+	}
+	if *socksUser != "" {
+		opts = append(opts, proxy.WithSOCKS5Auth(*socksUser, *socksPassword))
+	}
+	opts = append(opts, proxy.WithCertCache(*certCacheSize, *certCacheDir))
+	if *certDir != "" {
+		opts = append(opts, proxy.WithCertStore(*certDir))
+	}
+	opts = append(opts, proxy.WithMagicHost(*magicHost, *addr))
+	if *mirrorCerts {
+		opts = append(opts, proxy.WithMirroredCerts())
+	}
+	if *keyLogFile != "" {
+		keyLog, err := os.OpenFile(*keyLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			slog.Error("Error opening key log file", slog.String("file", *keyLogFile), slog.String("err", err.Error()))
+			return
+		}
+		defer keyLog.Close()
+		slog.Warn("Writing TLS secrets to key log file", slog.String("file", *keyLogFile))
+		opts = append(opts, proxy.WithKeyLog(keyLog))
+	}
+	if *pcapDir != "" {
+		opts = append(opts, proxy.WithPcapDir(*pcapDir))
+	}
+	if *tlsFingerprint != "" {
+		opts = append(opts, proxy.WithTLSFingerprint(*tlsFingerprint))
+	}
+
+	proxySSl := proxy.NewProxySslServer(*caCertFile, *caKeyFile, requestRules, responseRules, opts...)
+	defer proxySSl.Close()
+
+	if *transparentAddr != "" {
+		slog.Info("Starting transparent proxy server on", slog.String("addr", *transparentAddr), slog.Bool("tproxy", *tproxy))
+
+		ln, err := proxy.ListenTransparent(*transparentAddr, *tproxy)
+		if err != nil {
+			slog.Error("Error listening on", slog.String("addr", *transparentAddr), slog.String("err", err.Error()))
+			return
+		}
+
+		go serve(ln, func(conn net.Conn) {
+			proxySSl.HandleTransparent(conn, *tproxy)
+		})
+	}
+
+	if *socksAddr != "" {
+		slog.Info("Starting SOCKS5 proxy server on", slog.String("addr", *socksAddr))
+
+		ln, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			slog.Error("Error listening on", slog.String("addr", *socksAddr), slog.String("err", err.Error()))
+			return
+		}
+
+		go serve(ln, proxySSl.HandleSOCKS5)
+	}
 
 	slog.Info("Starting proxy server on", slog.String("addr", *addr))
 
@@ -111,6 +209,25 @@ func main() {
 		return
 	}
 
+	serve(ln, proxySSl.HandleTLS)
+}
+
+// logTestResult logs the outcome of applying a change rule with -test. Rules
+// answering the request or resetting the connection did what they are for.
+func logTestResult(change string, r *rule.Rule, err error) {
+	var respond *rule.RespondError
+	switch {
+	case err == nil:
+	case errors.As(err, &respond):
+		slog.Info("Rule responded", slog.String("rule", r.Name), slog.String("change", change), slog.Int("status", respond.Response.StatusCode))
+	case errors.Is(err, rule.ErrReset):
+		slog.Info("Rule resets the connection", slog.String("rule", r.Name), slog.String("change", change))
+	default:
+		slog.Error("Error applying "+change+" rule", slog.String("rule", r.Name), slog.String("err", err.Error()))
+	}
+}
+
+func serve(ln net.Listener, handle func(net.Conn)) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -118,6 +235,6 @@ func main() {
 			continue
 		}
 
-		go proxySSl.HandleTLS(conn)
+		go handle(conn)
 	}
 }
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CA is a generated certificate authority in the formats clients and
+// operating systems import.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// GenerateCA creates a self-signed CA named name, valid for validity, with a
+// key of keyType (see generateKey).
+func GenerateCA(name, keyType string, validity time.Duration) (*CA, error) {
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{"MITM proxy"},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(validity),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// CertPEM returns the certificate PEM encoded.
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// CertDER returns the certificate DER encoded, as imported by Android and
+// Windows.
+func (ca *CA) CertDER() []byte {
+	return ca.Cert.Raw
+}
+
+// KeyPEM returns the private key as PKCS#8 PEM.
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// PKCS12 returns the certificate and private key as a PKCS#12 bundle
+// protected by password. The bundle is encrypted with 3DES, which keychains
+// and older OpenSSL versions import, or with AES-256 and PBKDF2 when modern
+// is set.
+func (ca *CA) PKCS12(password string, modern bool) ([]byte, error) {
+	encoder := pkcs12.LegacyDES
+	if modern {
+		encoder = pkcs12.Modern
+	}
+
+	return encoder.Encode(ca.Key, ca.Cert, nil, password)
+}
+
+// keyGenerators create private keys by key type.
+var keyGenerators = map[string]func() (crypto.Signer, error){
+	"ecdsa":      func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	"ecdsa-p256": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	"ecdsa-p384": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+	"rsa":        func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	"rsa-2048":   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	"rsa-3072":   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 3072) },
+	"rsa-4096":   func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) },
+}
+
+// generateKey creates a private key of keyType: "ecdsa" (P-256),
+// "ecdsa-p384", "rsa" (2048 bits), "rsa-3072" or "rsa-4096".
+func generateKey(keyType string) (crypto.Signer, error) {
+	generate, ok := keyGenerators[keyType]
+	if !ok {
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+
+	return generate()
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestGenerateCA(t *testing.T) {
+	ca, err := GenerateCA("Test CA", "ecdsa", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+
+	if !ca.Cert.IsCA || ca.Cert.Subject.CommonName != "Test CA" {
+		t.Errorf("unexpected CA certificate %v", ca.Cert.Subject)
+	}
+	if err = ca.Cert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("CA is not self-signed: %v", err)
+	}
+
+	for _, modern := range []bool{false, true} {
+		p12, err := ca.PKCS12("secret", modern)
+		if err != nil {
+			t.Fatalf("PKCS12: %v", err)
+		}
+		key, cert, err := pkcs12.Decode(p12, "secret")
+		if err != nil {
+			t.Fatalf("decode PKCS12: %v", err)
+		}
+		if !cert.Equal(ca.Cert) || !key.(*ecdsa.PrivateKey).Equal(ca.Key) {
+			t.Errorf("modern=%v: PKCS12 doesn't hold the CA", modern)
+		}
+	}
+
+	if _, err = GenerateCA("Test CA", "dsa", time.Hour); err == nil {
+		t.Error("expected an unknown key type to be rejected")
+	}
+}
+
+func TestLoadX509KeyPairFormats(t *testing.T) {
+	ecCA, err := GenerateCA("EC CA", "ecdsa", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	rsaCA, err := GenerateCA("RSA CA", "rsa", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+
+	sec1, err := x509.MarshalECPrivateKey(ecCA.Key.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	pkcs8, err := ecCA.KeyPEM()
+	if err != nil {
+		t.Fatalf("KeyPEM: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ca   *CA
+		key  []byte
+	}{
+		{"pkcs8", ecCA, pkcs8},
+		{"sec1", ecCA, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})},
+		{"pkcs1", rsaCA, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaCA.Key.(*rsa.PrivateKey))})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile := filepath.Join(dir, "ca.pem")
+			keyFile := filepath.Join(dir, "ca-key.pem")
+			combinedFile := filepath.Join(dir, "combined.pem")
+			os.WriteFile(certFile, tt.ca.CertPEM(), 0o600)
+			os.WriteFile(keyFile, tt.key, 0o600)
+			os.WriteFile(combinedFile, append(tt.ca.CertPEM(), tt.key...), 0o600)
+
+			for _, files := range [][2]string{{certFile, keyFile}, {combinedFile, ""}} {
+				cert, key, err := loadX509KeyPair(files[0], files[1])
+				if err != nil {
+					t.Fatalf("loadX509KeyPair(%q, %q): %v", files[0], files[1], err)
+				}
+				if !cert.Equal(tt.ca.Cert) {
+					t.Error("unexpected certificate")
+				}
+				if !key.(interface{ Equal(crypto.PrivateKey) bool }).Equal(tt.ca.Key) {
+					t.Error("unexpected key")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCertCacheSize = 10000
+
+// certRenewFraction is the part of a certificate's lifetime left when it is
+// considered stale and minted again.
+const certRenewFraction = 10
+
+// mirrorHintTTL is how long the certificate mirrored for a host is used
+// before the origin is dialed again to check for a renewed certificate.
+const mirrorHintTTL = time.Hour
+
+// certCache is an LRU cache of forged certificates. Certificates close to
+// expiry are treated as missing, so callers mint a fresh one. When dir is set
+// certificates are also written to disk and read back on a miss, which keeps
+// them stable across restarts. Their file names include version, so a
+// certificate minted with other leaf settings is not read back. Files that
+// can't be used anymore are deleted, and the directory holds at most size
+// certificates. Hints map
+// names to cache keys for a while, for certificates keyed by something a
+// caller can't derive from the name alone.
+type certCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	hints   map[string]certHint
+
+	dir     string
+	version string
+	issuer  *x509.Certificate
+	chain   [][]byte
+}
+
+type certCacheEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+type certHint struct {
+	key     string
+	expires time.Time
+}
+
+// newCertCache returns a cache holding up to size certificates. Certificates
+// read from dir are only used when they were stored with version and signed
+// by issuer, and are sent with chain.
+func newCertCache(size int, dir, version string, issuer *x509.Certificate, chain [][]byte) (*certCache, error) {
+	if size <= 0 {
+		size = defaultCertCacheSize
+	}
+
+	c := &certCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		hints:   make(map[string]certHint),
+		dir:     dir,
+		version: version,
+		issuer:  issuer,
+		chain:   chain,
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		c.prune()
+	}
+
+	return c, nil
+}
+
+// prune deletes the files in the directory left by a crashed save, minted
+// with other leaf settings or by another issuer, or about to expire. Only
+// the size most recently written certificates are kept.
+func (c *certCache) prune() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		slog.Warn("Failed to read certificate cache", slog.String("dir", c.dir), slog.String("err", err.Error()))
+		return
+	}
+
+	type file struct {
+		name    string
+		modTime time.Time
+	}
+	var kept []file
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case strings.HasPrefix(name, ".tmp-"):
+			c.remove(filepath.Join(c.dir, name))
+		case !strings.HasSuffix(name, ".pem"):
+		case !strings.HasSuffix(name, c.suffix()) || !c.usable(filepath.Join(c.dir, name)):
+			c.remove(filepath.Join(c.dir, name))
+		default:
+			if info, err := entry.Info(); err == nil {
+				kept = append(kept, file{name, info.ModTime()})
+			}
+		}
+	}
+
+	if len(kept) > c.size {
+		slices.SortFunc(kept, func(a, b file) int { return b.modTime.Compare(a.modTime) })
+		for _, f := range kept[c.size:] {
+			c.remove(filepath.Join(c.dir, f.name))
+		}
+	}
+}
+
+// usable reports whether the certificate in file path is fresh and signed
+// by the issuer.
+func (c *certCache) usable(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	return fresh(cert) && cert.CheckSignatureFrom(c.issuer) == nil
+}
+
+func (c *certCache) remove(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to delete cached certificate", slog.String("file", path), slog.String("err", err.Error()))
+	}
+}
+
+// get returns the cached certificate for key, or nil when there is none or
+// it is about to expire.
+func (c *certCache) get(key string) *tls.Certificate {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		cert := e.Value.(*certCacheEntry).cert
+		if fresh(cert.Leaf) {
+			c.lru.MoveToFront(e)
+			c.mu.Unlock()
+			return cert
+		}
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	cert := c.load(key)
+	if cert != nil {
+		c.store(key, cert)
+	}
+
+	return cert
+}
+
+// add caches cert under key and persists it when the cache has a directory.
+func (c *certCache) add(key string, cert *tls.Certificate) {
+	c.store(key, cert)
+	c.save(key, cert)
+}
+
+// hint returns the cache key recorded for name, unless it expired.
+func (c *certCache) hint(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.hints[name]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(h.expires) {
+		delete(c.hints, name)
+		return "", false
+	}
+
+	return h.key, true
+}
+
+// setHint records key for name for ttl. Like the certificates, at most size
+// hints are kept.
+func (c *certCache) setHint(name, key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.hints[name]; !ok && len(c.hints) >= c.size {
+		for n, h := range c.hints {
+			if now.After(h.expires) {
+				delete(c.hints, n)
+			}
+		}
+		// Still full, drop any hint, it only costs a dial.
+		for n := range c.hints {
+			if len(c.hints) < c.size {
+				break
+			}
+			delete(c.hints, n)
+		}
+	}
+
+	c.hints[name] = certHint{key: key, expires: now.Add(ttl)}
+}
+
+func (c *certCache) store(key string, cert *tls.Certificate) {
+	c.mu.Lock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*certCacheEntry).cert = cert
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&certCacheEntry{key: key, cert: cert})
+
+	var evicted []string
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certCacheEntry).key)
+		evicted = append(evicted, oldest.Value.(*certCacheEntry).key)
+	}
+	c.mu.Unlock()
+
+	// The directory holds no more certificates than the cache.
+	if c.dir != "" {
+		for _, key := range evicted {
+			c.remove(c.path(key))
+		}
+	}
+}
+
+func (c *certCache) load(key string) *tls.Certificate {
+	if c.dir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to read cached certificate", slog.String("key", key), slog.String("err", err.Error()))
+		}
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		slog.Warn("Failed to parse cached certificate", slog.String("key", key), slog.String("err", err.Error()))
+		c.remove(c.path(key))
+		return nil
+	}
+
+	if !fresh(cert.Leaf) || cert.Leaf.CheckSignatureFrom(c.issuer) != nil {
+		c.remove(c.path(key))
+		return nil
+	}
+	cert.Certificate = append(cert.Certificate[:1], c.chain...)
+
+	return &cert
+}
+
+func (c *certCache) save(key string, cert *tls.Certificate) {
+	if c.dir == "" {
+		return
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		slog.Warn("Failed to marshal certificate key", slog.String("key", key), slog.String("err", err.Error()))
+		return
+	}
+
+	// Only the leaf is stored, the chain may change between runs.
+	var data bytes.Buffer
+	pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	pem.Encode(&data, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+
+	// Write to a temporary file first so a concurrent reader never sees a
+	// partial certificate.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		slog.Warn("Failed to cache certificate", slog.String("key", key), slog.String("err", err.Error()))
+		return
+	}
+	_, err = tmp.Write(data.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Warn("Failed to cache certificate", slog.String("key", key), slog.String("err", err.Error()))
+	}
+}
+
+// path maps a cache key to a file name, hex escaping characters that are
+// not safe in file names, followed by the version.
+func (c *certCache) path(key string) string {
+	var name strings.Builder
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9', b == '.', b == '-':
+			name.WriteByte(b)
+		default:
+			fmt.Fprintf(&name, "_%02x", b)
+		}
+	}
+
+	return filepath.Join(c.dir, name.String()+c.suffix())
+}
+
+// suffix ends the file names of certificates stored with the version.
+func (c *certCache) suffix() string {
+	if c.version == "" {
+		return ".pem"
+	}
+
+	return "-" + c.version + ".pem"
+}
+
+// fresh reports whether cert has more than 1/certRenewFraction of its
+// lifetime left.
+func fresh(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+
+	renewBefore := cert.NotAfter.Sub(cert.NotBefore) / certRenewFraction
+
+	return time.Now().Add(renewBefore).Before(cert.NotAfter)
+}
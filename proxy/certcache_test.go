@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCertCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	p := newTestServer(t, "")
+	p.certs.size = 2
+
+	a := p.getTlsCert("a.example.com")
+	p.getTlsCert("b.example.com")
+	p.getTlsCert("a.example.com")
+	p.getTlsCert("c.example.com")
+
+	if p.certs.get("a.example.com") != a {
+		t.Error("expected recently used certificate to stay cached")
+	}
+	if p.certs.get("b.example.com") != nil {
+		t.Error("expected least recently used certificate to be evicted")
+	}
+	if p.certs.lru.Len() != 2 {
+		t.Errorf("expected 2 cached certificates, got %d", p.certs.lru.Len())
+	}
+}
+
+func TestCertCacheRenewsExpiringCerts(t *testing.T) {
+	p := newTestServer(t, "")
+
+	template := &x509.Certificate{
+		Subject:   pkix.Name{Organization: []string{"MITM proxy"}},
+		DNSNames:  []string{"old.example.com"},
+		NotBefore: time.Now().Add(-239 * time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	pemCert, pemKey, err := createCert(template, p.caCert, p.caKey, nil)
+	if err != nil {
+		t.Fatalf("createCert: %v", err)
+	}
+	old, err := tls.X509KeyPair(pemCert, pemKey)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	p.certs.add("old.example.com", &old)
+
+	renewed := p.getTlsCert("old.example.com")
+	if renewed == &old || !renewed.Leaf.NotAfter.After(old.Leaf.NotAfter) {
+		t.Fatal("expected an expiring certificate to be minted again")
+	}
+}
+
+func TestCertCacheHints(t *testing.T) {
+	p := newTestServer(t, "")
+	p.certs.size = 2
+
+	p.certs.setHint("a", "key-a", time.Hour)
+	p.certs.setHint("b", "key-b", -time.Second)
+	if key, ok := p.certs.hint("a"); !ok || key != "key-a" {
+		t.Errorf("got %q, %v", key, ok)
+	}
+	if _, ok := p.certs.hint("b"); ok {
+		t.Error("expected an expired hint to be ignored")
+	}
+
+	p.certs.setHint("c", "key-c", time.Hour)
+	p.certs.setHint("d", "key-d", time.Hour)
+	if len(p.certs.hints) != 2 {
+		t.Errorf("expected 2 hints, got %d", len(p.certs.hints))
+	}
+	if key, ok := p.certs.hint("d"); !ok || key != "key-d" {
+		t.Errorf("got %q, %v", key, ok)
+	}
+}
+
+func TestCertCachePersists(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestServer(t, dir)
+
+	cert := p.getTlsCert("*.example.com")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "_2a.example.com-"+p.leafCert.hash+".pem" {
+		t.Fatalf("expected one persisted certificate, got %v %v", entries, err)
+	}
+
+	restarted, err := newCertCache(0, dir, p.leafCert.hash, p.caCert, nil)
+	if err != nil {
+		t.Fatalf("newCertCache: %v", err)
+	}
+	loaded := restarted.get("*.example.com")
+	if loaded == nil || !loaded.Leaf.Equal(cert.Leaf) {
+		t.Fatal("expected the persisted certificate to be loaded")
+	}
+
+	// Certificates minted with other leaf settings are minted again.
+	leafCert := &LeafCert{Validity: "48h"}
+	if err = leafCert.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if leafCert.hash == p.leafCert.hash {
+		t.Fatal("expected other leaf settings to change the hash")
+	}
+	reconfigured, err := newCertCache(0, dir, leafCert.hash, p.caCert, nil)
+	if err != nil {
+		t.Fatalf("newCertCache: %v", err)
+	}
+	if reconfigured.get("*.example.com") != nil {
+		t.Error("expected a certificate minted with other leaf settings to be ignored")
+	}
+
+	other := newTestServer(t, dir)
+	if other.certs.get("*.example.com") != nil {
+		t.Error("expected a certificate signed by another CA to be ignored")
+	}
+}
+
+func TestCertCachePrunes(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestServer(t, dir)
+	p.certs.size = 2
+
+	expiring := &x509.Certificate{
+		DNSNames:  []string{"expiring.example.com"},
+		NotBefore: time.Now().Add(-239 * time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	pemCert, pemKey, err := createCert(expiring, p.caCert, p.caKey, nil)
+	if err != nil {
+		t.Fatalf("createCert: %v", err)
+	}
+	cert, err := tls.X509KeyPair(pemCert, pemKey)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	p.certs.save("expiring.example.com", &cert)
+	p.getTlsCert("a.example.com")
+	p.getTlsCert("b.example.com")
+
+	// An evicted certificate is deleted with the entry.
+	p.getTlsCert("c.example.com")
+	if _, err = os.Stat(p.certs.path("a.example.com")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the evicted certificate to be deleted, got %v", err)
+	}
+
+	// So is one found about to expire.
+	if p.certs.get("expiring.example.com") != nil {
+		t.Error("expected the expiring certificate to be ignored")
+	}
+	if _, err = os.Stat(p.certs.path("expiring.example.com")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the expiring certificate to be deleted, got %v", err)
+	}
+
+	// A restart deletes files minted with other leaf settings, left by a
+	// crashed save or beyond the cache size, and keeps foreign files.
+	p.certs.save("expiring.example.com", &cert)
+	for name, data := range map[string]string{"old-0123.pem": string(pemCert), ".tmp-1": "", "notes.txt": "keep"} {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Minute)
+	if err = os.Chtimes(p.certs.path("b.example.com"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newCertCache(1, dir, p.leafCert.hash, p.caCert, nil); err != nil {
+		t.Fatalf("newCertCache: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"c.example.com-" + p.leafCert.hash + ".pem", "notes.txt"}; !slices.Equal(names, want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+}
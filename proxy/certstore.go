@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certStorePollInterval = 5 * time.Second
+
+// certStore holds certificates presented instead of forged ones. Every
+// *.pem or *.crt file in dir with a certificate is loaded, with its key from
+// the same file, <name>.key or <name>-key.pem. Certificates are selected by
+// the names in their SANs.
+type certStore struct {
+	dir string
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	// files maps the file names certificates were loaded from to them.
+	files map[string]*tls.Certificate
+	stamp string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newCertStore loads the certificates in dir.
+func newCertStore(dir string) (*certStore, error) {
+	s := &certStore{dir: dir, stop: make(chan struct{})}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// get returns the certificate for host, preferring an exact name over a
+// wildcard, or nil when no certificate in the store covers host.
+func (s *certStore) get(host string) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var wildcard *tls.Certificate
+	for _, cert := range s.certs {
+		if cert.Leaf.VerifyHostname(host) != nil {
+			continue
+		}
+		for _, name := range cert.Leaf.DNSNames {
+			if strings.EqualFold(name, host) {
+				return cert
+			}
+		}
+		if wildcard == nil {
+			wildcard = cert
+		}
+	}
+
+	return wildcard
+}
+
+// watch reloads the store whenever files in the directory change, until
+// the store is closed.
+func (s *certStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				slog.Warn("Failed to reload certificate store", slog.String("dir", s.dir), slog.String("err", err.Error()))
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops watch.
+func (s *certStore) close() {
+	if s == nil {
+		return
+	}
+
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// reload loads the directory again when the names, sizes or modification
+// times of its files changed since the last load. A file failing to load
+// keeps the certificate loaded from it before, so a certificate and key
+// rotated one after the other don't drop the host in between.
+func (s *certStore) reload() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var stamp strings.Builder
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+
+	s.mu.RLock()
+	unchanged := s.stamp == stamp.String()
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	s.mu.RLock()
+	previous := s.files
+	s.mu.RUnlock()
+
+	var certs []*tls.Certificate
+	files := make(map[string]*tls.Certificate)
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || ext != ".pem" && ext != ".crt" || strings.HasSuffix(name, "-key.pem") {
+			continue
+		}
+
+		cert, err := s.loadPair(name)
+		if err != nil {
+			if cert = previous[name]; cert == nil {
+				slog.Warn("Skipping certificate", slog.String("file", filepath.Join(s.dir, name)), slog.String("err", err.Error()))
+				continue
+			}
+			slog.Warn("Keeping the previous certificate", slog.String("file", filepath.Join(s.dir, name)), slog.String("err", err.Error()))
+		}
+		if cert != nil {
+			certs = append(certs, cert)
+			files[name] = cert
+		}
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.files = files
+	s.stamp = stamp.String()
+	s.mu.Unlock()
+
+	slog.Info("Loaded certificate store", slog.String("dir", s.dir), slog.Int("certificates", len(certs)))
+
+	return nil
+}
+
+// loadPair loads the certificate in file name and its key. It returns nil
+// without an error for files holding no certificate.
+func (s *certStore) loadPair(name string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(certPEM, []byte("CERTIFICATE-----")) {
+		return nil, nil
+	}
+
+	keyPEM := certPEM
+	if !bytes.Contains(certPEM, []byte("PRIVATE KEY-----")) {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		for _, keyName := range []string{base + ".key", base + "-key.pem"} {
+			keyPEM, err = os.ReadFile(filepath.Join(s.dir, keyName))
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no private key found for %s", name)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
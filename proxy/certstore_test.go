@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, p Server, dir, name string, dnsNames ...string) {
+	t.Helper()
+
+	template := &x509.Certificate{
+		DNSNames:  dnsNames,
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	pemCert, pemKey, err := createCert(template, p.caCert, p.caKey, nil)
+	if err != nil {
+		t.Fatalf("createCert: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, name+".crt"), pemCert, 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, name+".key"), pemKey, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	p := newTestServer(t, "")
+	dir := t.TempDir()
+	writeTestCert(t, p, dir, "wildcard", "*.dev.example.com")
+
+	store, err := newCertStore(dir)
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+
+	if cert := store.get("api.dev.example.com"); cert == nil || cert.Leaf.DNSNames[0] != "*.dev.example.com" {
+		t.Fatal("expected the wildcard certificate")
+	}
+	if store.get("example.com") != nil {
+		t.Error("expected no certificate for an uncovered host")
+	}
+
+	writeTestCert(t, p, dir, "api", "api.dev.example.com")
+	if err = store.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if cert := store.get("api.dev.example.com"); cert == nil || cert.Leaf.DNSNames[0] != "api.dev.example.com" {
+		t.Error("expected the exact certificate to win over the wildcard")
+	}
+	if cert := store.get("web.dev.example.com"); cert == nil || cert.Leaf.DNSNames[0] != "*.dev.example.com" {
+		t.Error("expected the wildcard certificate for other subdomains")
+	}
+
+	if (*certStore)(nil).get("api.dev.example.com") != nil {
+		t.Error("expected a nil store to have no certificates")
+	}
+}
+
+func TestCertStoreKeepsCertDuringRotation(t *testing.T) {
+	p := newTestServer(t, "")
+	dir := t.TempDir()
+	writeTestCert(t, p, dir, "api", "api.example.com")
+
+	store, err := newCertStore(dir)
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+	old := store.get("api.example.com")
+
+	// The new certificate is written before its key.
+	oldKey, err := os.ReadFile(filepath.Join(dir, "api.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, p, dir, "api", "api.example.com", "www.example.com")
+	newKey, err := os.ReadFile(filepath.Join(dir, "api.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "api.key"), oldKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if store.get("api.example.com") != old {
+		t.Error("expected the previous certificate while the key doesn't match")
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "api.key"), newKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if cert := store.get("www.example.com"); cert == nil || cert == old {
+		t.Error("expected the rotated certificate")
+	}
+}
+
+func TestCertStoreClose(t *testing.T) {
+	store, err := newCertStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		store.watch(time.Millisecond)
+		close(done)
+	}()
+	store.close()
+	store.close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected watch to stop")
+	}
+}
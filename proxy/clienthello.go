@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	recordHeaderLen          = 5
+	maxPlaintextLen          = 16384
+
+	extensionServerName = 0
+	extensionALPN       = 16
+)
+
+var errShortClientHello = errors.New("truncated ClientHello")
+
+type clientHello struct {
+	// raw is the whole TLS record carrying the ClientHello.
+	raw        []byte
+	serverName string
+	alpn       []string
+}
+
+// peekClientHello parses the TLS ClientHello at the head of br without
+// consuming it, so the connection can still be handed to tls.Server.
+// The reader must be able to buffer a whole TLS record.
+func peekClientHello(br *bufio.Reader) (*clientHello, error) {
+	header, err := br.Peek(recordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != recordTypeHandshake {
+		return nil, fmt.Errorf("not a TLS handshake record: %#x", header[0])
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > maxPlaintextLen {
+		return nil, fmt.Errorf("TLS record too large: %d", length)
+	}
+
+	record, err := br.Peek(recordHeaderLen + length)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := parseClientHello(record[recordHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	hello.raw = append([]byte(nil), record...)
+
+	return hello, nil
+}
+
+func parseClientHello(data []byte) (*clientHello, error) {
+	s := byteString(data)
+
+	msgType, ok := s.readUint8()
+	if !ok || msgType != handshakeTypeClientHello {
+		return nil, errors.New("not a ClientHello message")
+	}
+
+	body, ok := s.readBytes24()
+	if !ok {
+		return nil, errShortClientHello
+	}
+
+	hello := &clientHello{}
+
+	// client_version, random
+	if !body.skip(2 + 32) {
+		return nil, errShortClientHello
+	}
+	// session_id, cipher_suites, compression_methods
+	if _, ok = body.readBytes8(); !ok {
+		return nil, errShortClientHello
+	}
+	if _, ok = body.readBytes16(); !ok {
+		return nil, errShortClientHello
+	}
+	if _, ok = body.readBytes8(); !ok {
+		return nil, errShortClientHello
+	}
+
+	if len(body) == 0 {
+		return hello, nil
+	}
+
+	extensions, ok := body.readBytes16()
+	if !ok {
+		return nil, errShortClientHello
+	}
+
+	for len(extensions) > 0 {
+		extType, ok := extensions.readUint16()
+		if !ok {
+			return nil, errShortClientHello
+		}
+		extData, ok := extensions.readBytes16()
+		if !ok {
+			return nil, errShortClientHello
+		}
+
+		switch extType {
+		case extensionServerName:
+			names, ok := extData.readBytes16()
+			if !ok {
+				return nil, errShortClientHello
+			}
+			for len(names) > 0 {
+				nameType, ok := names.readUint8()
+				if !ok {
+					return nil, errShortClientHello
+				}
+				name, ok := names.readBytes16()
+				if !ok {
+					return nil, errShortClientHello
+				}
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case extensionALPN:
+			protos, ok := extData.readBytes16()
+			if !ok {
+				return nil, errShortClientHello
+			}
+			for len(protos) > 0 {
+				proto, ok := protos.readBytes8()
+				if !ok {
+					return nil, errShortClientHello
+				}
+				hello.alpn = append(hello.alpn, string(proto))
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+// byteString is a minimal reader over length-prefixed TLS structures.
+type byteString []byte
+
+func (s *byteString) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *byteString) read(n int) (byteString, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *byteString) readUint8() (uint8, bool) {
+	v, ok := s.read(1)
+	if !ok {
+		return 0, false
+	}
+	return v[0], true
+}
+
+func (s *byteString) readUint16() (uint16, bool) {
+	v, ok := s.read(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+func (s *byteString) readBytes8() (byteString, bool) {
+	n, ok := s.readUint8()
+	if !ok {
+		return nil, false
+	}
+	return s.read(int(n))
+}
+
+func (s *byteString) readBytes16() (byteString, bool) {
+	n, ok := s.readUint16()
+	if !ok {
+		return nil, false
+	}
+	return s.read(int(n))
+}
+
+func (s *byteString) readBytes24() (byteString, bool) {
+	v, ok := s.read(3)
+	if !ok {
+		return nil, false
+	}
+	return s.read(int(v[0])<<16 | int(v[1])<<8 | int(v[2]))
+}
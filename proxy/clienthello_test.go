@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		}).Handshake()
+	}()
+
+	br := bufio.NewReaderSize(server, recordHeaderLen+maxPlaintextLen)
+	hello, err := peekClientHello(br)
+	if err != nil {
+		t.Fatalf("peekClientHello: %v", err)
+	}
+
+	if hello.serverName != "example.com" {
+		t.Errorf("expected server name %q, got %q", "example.com", hello.serverName)
+	}
+	if !reflect.DeepEqual(hello.alpn, []string{"h2", "http/1.1"}) {
+		t.Errorf("unexpected ALPN %v", hello.alpn)
+	}
+
+	// The ClientHello must still be available to the TLS server.
+	if br.Buffered() != len(hello.raw) {
+		t.Errorf("expected %d buffered bytes, got %d", len(hello.raw), br.Buffered())
+	}
+}
+
+func TestParseClientHelloRejectsGarbage(t *testing.T) {
+	if _, err := parseClientHello([]byte{0x01, 0x00, 0x00, 0x10, 0x03}); err == nil {
+		t.Fatal("expected error for truncated ClientHello")
+	}
+	if _, err := parseClientHello([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Fatal("expected error for non-TLS data")
+	}
+}
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the proxy settings read from the configuration file.
+type Config struct {
+	ClientTLS   *ClientTLS     `yaml:"client_tls"`
+	UpstreamTLS []*UpstreamTLS `yaml:"upstream_tls"`
+	Passthrough *Passthrough   `yaml:"passthrough"`
+	LeafCert    *LeafCert      `yaml:"leaf_cert"`
+}
+
+// ClientTLS is the TLS policy offered to intercepted clients. Overrides
+// apply to matching hosts and inherit the fields they leave unset.
+type ClientTLS struct {
+	ClientTLSPolicy `yaml:",inline"`
+	Overrides       []*ClientTLSPolicy `yaml:"overrides"`
+}
+
+type ClientTLSPolicy struct {
+	Hosts        []string `yaml:"hosts"`
+	MinVersion   string   `yaml:"min_version"`
+	MaxVersion   string   `yaml:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	Curves       []string `yaml:"curves"`
+	ALPN         []string `yaml:"alpn"`
+
+	tlsConfig *tls.Config
+}
+
+// UpstreamTLS configures TLS connections to origin servers matching Hosts.
+type UpstreamTLS struct {
+	Hosts              []string `yaml:"hosts"`
+	RootCAs            []string `yaml:"root_cas"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	ClientCert         string   `yaml:"client_cert"`
+	ClientKey          string   `yaml:"client_key"`
+	MinVersion         string   `yaml:"min_version"`
+	ServerName         string   `yaml:"server_name"`
+	// Fingerprint overrides the TLS fingerprint of the handshake with the
+	// hosts, see WithTLSFingerprint.
+	Fingerprint string `yaml:"fingerprint"`
+
+	tlsConfig *tls.Config
+}
+
+// WithConfig applies the settings of a configuration file.
+func WithConfig(cfg *Config) Option {
+	return func(s *Server) {
+		if cfg.ClientTLS != nil {
+			s.clientTLS = cfg.ClientTLS
+		}
+		s.upstreamTLS = cfg.UpstreamTLS
+		s.passthrough = cfg.Passthrough
+		if cfg.LeafCert != nil {
+			s.leafCert = cfg.LeafCert
+		}
+	}
+}
+
+// LoadConfig reads the configuration file. Rule expressions in it are
+// templated with envs the same way as rule files.
+func LoadConfig(path string, envs map[string]string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.ClientTLS != nil {
+		if err = cfg.ClientTLS.compile(); err != nil {
+			return nil, fmt.Errorf("client_tls: %v", err)
+		}
+	}
+
+	for i, u := range cfg.UpstreamTLS {
+		if err = u.compile(); err != nil {
+			return nil, fmt.Errorf("upstream_tls[%d]: %v", i, err)
+		}
+	}
+
+	if cfg.Passthrough != nil {
+		if err = cfg.Passthrough.compile(envs); err != nil {
+			return nil, fmt.Errorf("passthrough: %v", err)
+		}
+	}
+
+	if cfg.LeafCert != nil {
+		if err = cfg.LeafCert.compile(); err != nil {
+			return nil, fmt.Errorf("leaf_cert: %v", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// defaultClientTLS accepts clients from TLS 1.2 on and offers HTTP/2.
+func defaultClientTLS() *ClientTLS {
+	c := &ClientTLS{}
+	if err := c.compile(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *ClientTLS) compile() error {
+	if err := c.ClientTLSPolicy.compile(nil); err != nil {
+		return err
+	}
+
+	for i, o := range c.Overrides {
+		if len(o.Hosts) == 0 {
+			return fmt.Errorf("overrides[%d]: hosts are required", i)
+		}
+		if err := o.compile(&c.ClientTLSPolicy); err != nil {
+			return fmt.Errorf("overrides[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *ClientTLSPolicy) compile(parent *ClientTLSPolicy) error {
+	if parent != nil {
+		if c.MinVersion == "" {
+			c.MinVersion = parent.MinVersion
+		}
+		if c.MaxVersion == "" {
+			c.MaxVersion = parent.MaxVersion
+		}
+		if c.CipherSuites == nil {
+			c.CipherSuites = parent.CipherSuites
+		}
+		if c.Curves == nil {
+			c.Curves = parent.Curves
+		}
+		if c.ALPN == nil {
+			c.ALPN = parent.ALPN
+		}
+	}
+
+	cfg := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		NextProtos:       []string{http2.NextProtoTLS, "http/1.1"},
+	}
+
+	var err error
+	if c.MinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(c.MinVersion); err != nil {
+			return err
+		}
+	}
+	if c.MaxVersion != "" {
+		if cfg.MaxVersion, err = parseTLSVersion(c.MaxVersion); err != nil {
+			return err
+		}
+	}
+
+	if c.CipherSuites != nil {
+		cfg.CipherSuites = make([]uint16, 0, len(c.CipherSuites))
+		for _, name := range c.CipherSuites {
+			id, err := parseCipherSuite(name)
+			if err != nil {
+				return err
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if c.Curves != nil {
+		cfg.CurvePreferences = make([]tls.CurveID, 0, len(c.Curves))
+		for _, name := range c.Curves {
+			id, err := parseCurve(name)
+			if err != nil {
+				return err
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+
+	if c.ALPN != nil {
+		cfg.NextProtos = c.ALPN
+	}
+
+	// HTTP/2 clients abort with INADEQUATE_SECURITY below TLS 1.2 or with a
+	// cipher suite RFC 7540 forbids, so such policies only offer HTTP/1.1.
+	if !allowsHTTP2(cfg) {
+		if c.ALPN != nil && slices.Contains(c.ALPN, http2.NextProtoTLS) {
+			return fmt.Errorf("alpn %q needs min_version 1.2 and an HTTP/2 cipher suite", http2.NextProtoTLS)
+		}
+		cfg.NextProtos = slices.DeleteFunc(slices.Clone(cfg.NextProtos), func(proto string) bool {
+			return proto == http2.NextProtoTLS
+		})
+	}
+
+	c.tlsConfig = cfg
+
+	return nil
+}
+
+// clientTLSConfig returns the TLS config presented to clients connecting to
+// host, without certificates.
+func (p Server) clientTLSConfig(host string) *tls.Config {
+	cfg := p.clientTLS.tlsConfig.Clone()
+	for _, o := range p.clientTLS.Overrides {
+		if matchHosts(o.Hosts, host) {
+			cfg = o.tlsConfig.Clone()
+			break
+		}
+	}
+	cfg.KeyLogWriter = p.keyLog
+
+	return cfg
+}
+
+func (u *UpstreamTLS) compile() error {
+	if len(u.Hosts) == 0 {
+		return fmt.Errorf("hosts are required")
+	}
+
+	if u.InsecureSkipVerify {
+		for _, h := range u.Hosts {
+			if !isExactHost(h) {
+				return fmt.Errorf("insecure_skip_verify is only allowed for exact hostnames and IPs, not %q", h)
+			}
+		}
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: u.InsecureSkipVerify,
+		ServerName:         u.ServerName,
+	}
+
+	if len(u.RootCAs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range u.RootCAs {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+
+	if u.ClientCert != "" || u.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(u.ClientCert, u.ClientKey)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if u.MinVersion != "" {
+		version, err := parseTLSVersion(u.MinVersion)
+		if err != nil {
+			return err
+		}
+		cfg.MinVersion = version
+	}
+
+	if err := validateFingerprint(u.Fingerprint); err != nil {
+		return err
+	}
+
+	u.tlsConfig = cfg
+
+	return nil
+}
+
+// isExactHost reports whether the hosts pattern matches a single hostname
+// or IP, rather than a glob, a domain with its subdomains or a CIDR.
+func isExactHost(pattern string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if net.ParseIP(strings.Trim(pattern, "[]")) != nil {
+		return true
+	}
+	if pattern == "" || len(pattern) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(pattern, "."), ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// upstreamTLSConfig returns a TLS config for dialing host, built from the
+// first matching upstream_tls entry.
+func (p Server) upstreamTLSConfig(host string) *tls.Config {
+	for _, u := range p.upstreamTLS {
+		if matchHosts(u.Hosts, host) {
+			cfg := u.tlsConfig.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName = host
+			}
+			cfg.KeyLogWriter = p.keyLog
+			return cfg
+		}
+	}
+
+	return &tls.Config{ServerName: host, KeyLogWriter: p.keyLog}
+}
+
+// allowsHTTP2 reports whether cfg leaves HTTP/2 clients a handshake RFC 7540
+// accepts: TLS 1.2 or later, with an ephemeral key exchange and an AEAD
+// cipher under TLS 1.2. crypto/tls prefers such suites when the client
+// offers them, which HTTP/2 clients do.
+func allowsHTTP2(cfg *tls.Config) bool {
+	if cfg.MinVersion >= tls.VersionTLS13 {
+		return true
+	}
+	if cfg.MinVersion < tls.VersionTLS12 {
+		return false
+	}
+	if cfg.CipherSuites == nil {
+		return true
+	}
+
+	for _, id := range cfg.CipherSuites {
+		switch id {
+		case tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+func parseCurve(name string) (tls.CurveID, error) {
+	switch name {
+	case "X25519":
+		return tls.X25519, nil
+	case "X25519MLKEM768":
+		return tls.X25519MLKEM768, nil
+	case "P256":
+		return tls.CurveP256, nil
+	case "P384":
+		return tls.CurveP384, nil
+	case "P521":
+		return tls.CurveP521, nil
+	default:
+		return 0, fmt.Errorf("unknown curve %q", name)
+	}
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+}
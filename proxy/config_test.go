@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigUpstreamTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	data := `upstream_tls:
+  - hosts: ["legacy.internal"]
+    insecure_skip_verify: true
+    min_version: "1.2"
+  - hosts: ["10.0.0.0/8"]
+    server_name: "api.internal"
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	p := Server{upstreamTLS: cfg.UpstreamTLS}
+
+	legacy := p.upstreamTLSConfig("legacy.internal")
+	if !legacy.InsecureSkipVerify || legacy.MinVersion != tls.VersionTLS12 || legacy.ServerName != "legacy.internal" {
+		t.Errorf("unexpected config for legacy.internal: %+v", legacy)
+	}
+
+	if got := p.upstreamTLSConfig("10.1.2.3").ServerName; got != "api.internal" {
+		t.Errorf("expected server name override, got %q", got)
+	}
+
+	other := p.upstreamTLSConfig("example.com")
+	if other.InsecureSkipVerify || other.ServerName != "example.com" {
+		t.Errorf("unexpected default config: %+v", other)
+	}
+}
+
+func TestLoadConfigRejectsBroadInsecure(t *testing.T) {
+	for _, hosts := range []string{`"*"`, `"*.com"`, `"*.example.com"`, `"api-?.example.com"`, `"."`, `".example.com"`, `"0.0.0.0/0"`, `"10.0.0.0/8"`, `"legacy.internal", "*"`, `""`} {
+		path := filepath.Join(t.TempDir(), "proxy.yaml")
+		data := "upstream_tls:\n  - hosts: [" + hosts + "]\n    insecure_skip_verify: true\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+
+		if _, err := LoadConfig(path, nil); err == nil {
+			t.Errorf("%s: expected error for insecure_skip_verify on more than named hosts", hosts)
+		}
+	}
+}
+
+func TestIsExactHost(t *testing.T) {
+	for pattern, want := range map[string]bool{
+		"legacy.internal":  true,
+		"localhost":        true,
+		"my_host.lan":      true,
+		"10.1.2.3":         true,
+		"::1":              true,
+		"[2001:db8::1]":    true,
+		"*":                false,
+		"*.com":            false,
+		"api.*":            false,
+		"api[12].internal": false,
+		".":                false,
+		".example.com":     false,
+		"example..com":     false,
+		"-bad.example":     false,
+		"0.0.0.0/0":        false,
+		"":                 false,
+	} {
+		if got := isExactHost(pattern); got != want {
+			t.Errorf("isExactHost(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+func TestLoadConfigClientTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	data := `client_tls:
+  min_version: "1.3"
+  curves: ["P256"]
+  overrides:
+    - hosts: ["legacy.local"]
+      min_version: "1.0"
+      cipher_suites: ["TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"]
+      alpn: ["http/1.1"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	p := Server{clientTLS: cfg.ClientTLS}
+
+	if got := (Server{clientTLS: defaultClientTLS()}).clientTLSConfig("example.com").MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 by default, got %x", got)
+	}
+
+	global := p.clientTLSConfig("example.com")
+	if global.MinVersion != tls.VersionTLS13 || len(global.NextProtos) != 2 {
+		t.Errorf("unexpected global config: %+v", global)
+	}
+
+	legacy := p.clientTLSConfig("legacy.local")
+	if legacy.MinVersion != tls.VersionTLS10 {
+		t.Errorf("expected TLS 1.0 for override, got %x", legacy.MinVersion)
+	}
+	if len(legacy.CurvePreferences) != 1 || legacy.CurvePreferences[0] != tls.CurveP256 {
+		t.Errorf("expected curves inherited from global policy, got %v", legacy.CurvePreferences)
+	}
+	if len(legacy.CipherSuites) != 1 || legacy.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA {
+		t.Errorf("unexpected cipher suites %v", legacy.CipherSuites)
+	}
+	if len(legacy.NextProtos) != 1 || legacy.NextProtos[0] != "http/1.1" {
+		t.Errorf("unexpected ALPN %v", legacy.NextProtos)
+	}
+}
+
+func TestClientTLSPolicyHTTP2(t *testing.T) {
+	for _, tc := range []struct {
+		policy ClientTLSPolicy
+		alpn   []string
+		err    bool
+	}{
+		{policy: ClientTLSPolicy{}, alpn: []string{"h2", "http/1.1"}},
+		{policy: ClientTLSPolicy{MinVersion: "1.1"}, alpn: []string{"http/1.1"}},
+		{policy: ClientTLSPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA", "TLS_RSA_WITH_AES_128_GCM_SHA256"}}, alpn: []string{"http/1.1"}},
+		{policy: ClientTLSPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, alpn: []string{"h2", "http/1.1"}},
+		{policy: ClientTLSPolicy{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}}, alpn: []string{"h2", "http/1.1"}},
+		{policy: ClientTLSPolicy{MinVersion: "1.0", ALPN: []string{"h2", "http/1.1"}}, err: true},
+	} {
+		err := tc.policy.compile(nil)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tc.policy, err)
+			continue
+		}
+		if !slices.Equal(tc.policy.tlsConfig.NextProtos, tc.alpn) {
+			t.Errorf("%+v: got ALPN %v, want %v", tc.policy, tc.policy.tlsConfig.NextProtos, tc.alpn)
+		}
+	}
+}
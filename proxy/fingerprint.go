@@ -0,0 +1,424 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// fingerprintGo keeps the handshake of crypto/tls.
+	fingerprintGo = "go"
+	// fingerprintClient replays the ClientHello of the intercepted client.
+	fingerprintClient = "client"
+)
+
+// fingerprintProfiles are the browser ClientHellos the upstream handshake
+// can mimic.
+var fingerprintProfiles = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"android": utls.HelloAndroid_11_OkHttp,
+}
+
+// clientHelloKey carries the ClientHello of the intercepted client.
+type clientHelloKey struct{}
+
+// WithTLSFingerprint sets the ClientHello sent to origin servers: "go",
+// "client" to replay the one of the intercepted client, or a browser
+// profile. upstream_tls entries may override it per host.
+func WithTLSFingerprint(name string) Option {
+	return func(s *Server) {
+		s.tlsFingerprint = name
+	}
+}
+
+func validateFingerprint(name string) error {
+	if name == "" || name == fingerprintGo || name == fingerprintClient {
+		return nil
+	}
+	if _, ok := fingerprintProfiles[name]; !ok {
+		return fmt.Errorf("unknown TLS fingerprint %q", name)
+	}
+
+	return nil
+}
+
+// upstreamFingerprint returns the fingerprint of the handshake with host,
+// or an empty string when crypto/tls does the handshake.
+func (p Server) upstreamFingerprint(ctx context.Context, host string) string {
+	name := p.tlsFingerprint
+	for _, u := range p.upstreamTLS {
+		if matchHosts(u.Hosts, host) {
+			if u.Fingerprint != "" {
+				name = u.Fingerprint
+			}
+			break
+		}
+	}
+
+	switch name {
+	case "", fingerprintGo:
+		return ""
+	case fingerprintClient:
+		// Requests that didn't arrive over TLS have no ClientHello to replay.
+		if hello, _ := ctx.Value(clientHelloKey{}).(*clientHello); hello == nil {
+			return ""
+		}
+	}
+
+	return name
+}
+
+// usesFingerprints reports whether any upstream handshake may be done by
+// utls.
+func (p Server) usesFingerprints() bool {
+	if p.tlsFingerprint != "" && p.tlsFingerprint != fingerprintGo {
+		return true
+	}
+	for _, u := range p.upstreamTLS {
+		if u.Fingerprint != "" && u.Fingerprint != fingerprintGo {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialUTLS connects to the origin at addr with dial and the ClientHello of
+// the fingerprint for its host, offering nextProtos in ALPN.
+func (p Server) dialUTLS(ctx context.Context, dial dialFunc, addr string, nextProtos []string) (*utls.UConn, error) {
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := fingerprintSpec(ctx, p.upstreamFingerprint(ctx, serverName))
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = nextProtos
+		}
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	uconn := utls.UClient(conn, utlsConfig(p.upstreamTLSConfig(serverName)), utls.HelloCustom)
+	if err = uconn.ApplyPreset(spec); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to apply TLS fingerprint: %v", err)
+	}
+	if err = uconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return uconn, nil
+}
+
+// fingerprintSpec returns the ClientHello of the fingerprint name.
+func fingerprintSpec(ctx context.Context, name string) (*utls.ClientHelloSpec, error) {
+	if name == fingerprintClient {
+		hello, _ := ctx.Value(clientHelloKey{}).(*clientHello)
+		if hello == nil {
+			return nil, fmt.Errorf("no ClientHello to replay")
+		}
+		fingerprinter := &utls.Fingerprinter{AllowBluntMimicry: true}
+		return fingerprinter.FingerprintClientHello(hello.raw)
+	}
+
+	id, ok := fingerprintProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS fingerprint %q", name)
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &spec, nil
+}
+
+// utlsConfig converts the upstream TLS settings of a host for utls.
+func utlsConfig(cfg *tls.Config) *utls.Config {
+	ucfg := &utls.Config{
+		ServerName:         cfg.ServerName,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         cfg.MinVersion,
+		MaxVersion:         cfg.MaxVersion,
+		KeyLogWriter:       cfg.KeyLogWriter,
+	}
+	for _, cert := range cfg.Certificates {
+		ucfg.Certificates = append(ucfg.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		})
+	}
+
+	return ucfg
+}
+
+// fingerprintProtoTTL is how long the protocol negotiated by an origin is
+// remembered.
+const fingerprintProtoTTL = 10 * time.Minute
+
+// errProtocolSwitched is returned by a dial that negotiated another protocol
+// than the one remembered for the origin.
+var errProtocolSwitched = errors.New("origin switched protocols")
+
+// fingerprintTransport sends requests to hosts with a TLS fingerprint over
+// utls connections and everything else through the standard transport.
+// http.Transport only switches to HTTP/2 on *tls.Conn, so the protocol each
+// origin negotiates is remembered for fingerprintProtoTTL and its requests
+// go to an HTTP/1.1 or an HTTP/2 transport. The connection that found out
+// the protocol is handed to the transport that uses it, or closed when the
+// request didn't need it.
+type fingerprintTransport struct {
+	p    Server
+	dial dialFunc
+	std  *http.Transport
+	h1   *http.Transport
+	h2   *http2.Transport
+
+	mu      sync.Mutex
+	protos  map[string]originProto
+	pending map[string][]*utls.UConn
+}
+
+// originProto is the protocol an origin negotiated and until when it is
+// trusted.
+type originProto struct {
+	proto   string
+	expires time.Time
+}
+
+func (p Server) newFingerprintTransport(std *http.Transport, dial dialFunc) *fingerprintTransport {
+	t := &fingerprintTransport{
+		p:       p,
+		dial:    dial,
+		std:     std,
+		protos:  make(map[string]originProto),
+		pending: make(map[string][]*utls.UConn),
+	}
+	t.h1 = &http.Transport{
+		DialContext:         dial,
+		DialTLSContext:      t.dialH1,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+	}
+	t.h2 = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return t.dialH2(ctx, addr)
+		},
+		DisableCompression: true,
+		IdleConnTimeout:    idleConnTimeout,
+	}
+
+	return t
+}
+
+func (t *fingerprintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || t.p.upstreamFingerprint(req.Context(), req.URL.Hostname()) == "" {
+		return t.std.RoundTrip(req)
+	}
+	if http1Only, _ := req.Context().Value(http1OnlyKey{}).(bool); http1Only {
+		return t.h1.RoundTrip(req)
+	}
+
+	addr := getHost(req.URL.Host, "443")
+	resp, err := t.roundTrip(req, addr)
+	// The dial found out the new protocol of the origin before sending
+	// anything, so a request without a body is sent again.
+	if errors.Is(err, errProtocolSwitched) && (req.Body == nil || req.Body == http.NoBody) {
+		resp, err = t.roundTrip(req, addr)
+	}
+
+	return resp, err
+}
+
+func (t *fingerprintTransport) roundTrip(req *http.Request, addr string) (*http.Response, error) {
+	proto, conn, err := t.protocol(req.Context(), addr)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// A connection the transport didn't pick up, because it failed, the
+	// context was canceled or it had an idle one, is closed.
+	defer t.dropPending(addr, conn)
+
+	if proto == http2.NextProtoTLS {
+		return t.h2.RoundTrip(req)
+	}
+
+	return t.h1.RoundTrip(req)
+}
+
+// protocol returns the protocol negotiated by the origin at addr, dialing
+// it when it isn't known. The connection dialed is left for the transport
+// of the protocol and returned.
+func (t *fingerprintTransport) protocol(ctx context.Context, addr string) (string, *utls.UConn, error) {
+	t.mu.Lock()
+	known, ok := t.protos[addr]
+	t.mu.Unlock()
+	if ok && time.Now().Before(known.expires) {
+		return known.proto, nil, nil
+	}
+
+	conn, err := t.p.dialUTLS(ctx, t.dial, addr, []string{http2.NextProtoTLS, "http/1.1"})
+	if err != nil {
+		return "", nil, err
+	}
+	proto := conn.ConnectionState().NegotiatedProtocol
+
+	t.mu.Lock()
+	t.setProtocol(addr, proto)
+	t.pending[addr] = append(t.pending[addr], conn)
+	t.mu.Unlock()
+
+	return proto, conn, nil
+}
+
+// setProtocol remembers proto for addr and forgets expired protocols. t.mu
+// must be held.
+func (t *fingerprintTransport) setProtocol(addr, proto string) {
+	now := time.Now()
+	for a, known := range t.protos {
+		if !now.Before(known.expires) {
+			delete(t.protos, a)
+		}
+	}
+	t.protos[addr] = originProto{proto: proto, expires: now.Add(fingerprintProtoTTL)}
+}
+
+// takePending returns a connection to addr left by protocol that
+// negotiated HTTP/2, or HTTP/1.1 when h2 is false, if any.
+func (t *fingerprintTransport) takePending(addr string, h2 bool) *utls.UConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, conn := range t.pending[addr] {
+		if (conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS) == h2 {
+			t.removePending(addr, i)
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// dropPending closes conn unless a transport took it.
+func (t *fingerprintTransport) dropPending(addr string, conn *utls.UConn) {
+	if conn == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, c := range t.pending[addr] {
+		if c == conn {
+			t.removePending(addr, i)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// removePending removes the pending connection i of addr. t.mu must be
+// held.
+func (t *fingerprintTransport) removePending(addr string, i int) {
+	conns := append(t.pending[addr][:i], t.pending[addr][i+1:]...)
+	if len(conns) == 0 {
+		delete(t.pending, addr)
+		return
+	}
+	t.pending[addr] = conns
+}
+
+// CloseIdleConnections closes the idle connections of the transports and
+// the pending ones, and forgets the protocols of the origins.
+func (t *fingerprintTransport) CloseIdleConnections() {
+	t.std.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, conns := range t.pending {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	clear(t.pending)
+	clear(t.protos)
+}
+
+func (t *fingerprintTransport) dialH1(ctx context.Context, network, addr string) (net.Conn, error) {
+	http1Only, _ := ctx.Value(http1OnlyKey{}).(bool)
+	if !http1Only {
+		if conn := t.takePending(addr, false); conn != nil {
+			return conn, nil
+		}
+	}
+
+	nextProtos := []string{http2.NextProtoTLS, "http/1.1"}
+	if http1Only {
+		nextProtos = []string{"http/1.1"}
+	}
+	conn, err := t.p.dialUTLS(ctx, t.dial, addr, nextProtos)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		t.mu.Lock()
+		t.setProtocol(addr, http2.NextProtoTLS)
+		t.mu.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s to HTTP/2", errProtocolSwitched, addr)
+	}
+
+	return conn, nil
+}
+
+func (t *fingerprintTransport) dialH2(ctx context.Context, addr string) (net.Conn, error) {
+	if conn := t.takePending(addr, true); conn != nil {
+		return conn, nil
+	}
+
+	conn, err := t.p.dialUTLS(ctx, t.dial, addr, []string{http2.NextProtoTLS, "http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		t.mu.Lock()
+		t.setProtocol(addr, proto)
+		t.mu.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s to HTTP/1.1", errProtocolSwitched, addr)
+	}
+
+	return conn, nil
+}
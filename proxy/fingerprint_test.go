@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newFingerprintOrigin starts a TLS origin recording the cipher suites of
+// the last ClientHello it received.
+func newFingerprintOrigin(t *testing.T, h2 bool) (*httptest.Server, *[]uint16) {
+	var suites []uint16
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = h2
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			suites = hello.CipherSuites
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, &suites
+}
+
+func newFingerprintServer(srv *httptest.Server, fingerprint string) Server {
+	p := Server{
+		dialer:         &net.Dialer{},
+		tlsFingerprint: fingerprint,
+		upstreamTLS: []*UpstreamTLS{{
+			Hosts:     []string{"127.0.0.1"},
+			tlsConfig: &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+		}},
+	}
+	p.transport = p.newTransport()
+
+	return p
+}
+
+func fingerprintGet(t *testing.T, p Server, ctx context.Context, url string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestFingerprintProfile(t *testing.T) {
+	for _, h2 := range []bool{true, false} {
+		srv, suites := newFingerprintOrigin(t, h2)
+		p := newFingerprintServer(srv, "chrome")
+		if _, ok := p.transport.(*dstTransport).def.(*fingerprintTransport); !ok {
+			t.Fatalf("expected a fingerprint transport, got %T", p.transport.(*dstTransport).def)
+		}
+
+		want := "HTTP/1.1"
+		if h2 {
+			want = "HTTP/2.0"
+		}
+		for i := 0; i < 2; i++ {
+			if got := fingerprintGet(t, p, context.Background(), srv.URL); got != want {
+				t.Errorf("h2=%v: got protocol %q, want %q", h2, got, want)
+			}
+		}
+
+		// Chrome sends a GREASE cipher suite first, crypto/tls never does.
+		if len(*suites) == 0 || (*suites)[0]&0x0f0f != 0x0a0a {
+			t.Errorf("h2=%v: ClientHello doesn't look like Chrome: %x", h2, *suites)
+		}
+	}
+}
+
+func TestFingerprintClient(t *testing.T) {
+	srv, suites := newFingerprintOrigin(t, true)
+	p := newFingerprintServer(srv, fingerprintClient)
+
+	// Capture the ClientHello of a client offering only two suites.
+	clientSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	clientConn, proxyConn := net.Pipe()
+	go tls.Client(clientConn, &tls.Config{
+		ServerName:   "127.0.0.1",
+		CipherSuites: clientSuites,
+		MaxVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}).Handshake()
+	hello, err := peekClientHello(bufio.NewReaderSize(proxyConn, recordHeaderLen+maxPlaintextLen))
+	clientConn.Close()
+	proxyConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), clientHelloKey{}, hello)
+	if got := fingerprintGet(t, p, ctx, srv.URL); got != "HTTP/2.0" {
+		t.Errorf("got protocol %q", got)
+	}
+	if !slices.Equal(*suites, clientSuites) {
+		t.Errorf("origin got suites %x, want %x", *suites, clientSuites)
+	}
+
+	// Without a ClientHello to replay the handshake of crypto/tls is used.
+	if got := fingerprintGet(t, p, context.Background(), srv.URL); got != "HTTP/2.0" {
+		t.Errorf("got protocol %q", got)
+	}
+}
+
+func TestFingerprintProtocolSwitch(t *testing.T) {
+	var http1Only atomic.Bool
+	var srv *httptest.Server
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if !http1Only.Load() {
+				return nil, nil
+			}
+			cfg := srv.TLS.Clone()
+			cfg.NextProtos = []string{"http/1.1"}
+			return cfg, nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	p := newFingerprintServer(srv, "chrome")
+	ft := p.transport.(*dstTransport).def.(*fingerprintTransport)
+	addr := srv.Listener.Addr().String()
+
+	if got := fingerprintGet(t, p, context.Background(), srv.URL); got != "HTTP/2.0" {
+		t.Fatalf("got protocol %q", got)
+	}
+
+	// The origin drops HTTP/2: the next dial finds out and the request is
+	// sent again over HTTP/1.1.
+	http1Only.Store(true)
+	ft.h2.CloseIdleConnections()
+	if got := fingerprintGet(t, p, context.Background(), srv.URL); got != "HTTP/1.1" {
+		t.Errorf("got protocol %q after the switch to HTTP/1.1", got)
+	}
+
+	// And back to HTTP/2.
+	http1Only.Store(false)
+	ft.h1.CloseIdleConnections()
+	if got := fingerprintGet(t, p, context.Background(), srv.URL); got != "HTTP/2.0" {
+		t.Errorf("got protocol %q after the switch to HTTP/2", got)
+	}
+
+	// Expired protocols are dialed again, and the connection is closed when
+	// the transport reuses one it has.
+	ft.mu.Lock()
+	ft.protos[addr] = originProto{proto: http2.NextProtoTLS, expires: time.Now()}
+	ft.protos["stale.example:443"] = originProto{proto: "http/1.1", expires: time.Now()}
+	ft.mu.Unlock()
+	if got := fingerprintGet(t, p, context.Background(), srv.URL); got != "HTTP/2.0" {
+		t.Errorf("got protocol %q", got)
+	}
+	ft.mu.Lock()
+	pending, stale := len(ft.pending), ft.protos["stale.example:443"].proto
+	ft.mu.Unlock()
+	if pending != 0 || stale != "" {
+		t.Errorf("got %d pending connections, stale protocol %q", pending, stale)
+	}
+
+	ft.CloseIdleConnections()
+	ft.mu.Lock()
+	protos := len(ft.protos)
+	ft.mu.Unlock()
+	if protos != 0 {
+		t.Errorf("expected the protocols to be forgotten, got %d", protos)
+	}
+}
+
+func TestFingerprintPendingOnCancel(t *testing.T) {
+	srv, _ := newFingerprintOrigin(t, false)
+	p := newFingerprintServer(srv, "chrome")
+	ft := p.transport.(*dstTransport).def.(*fingerprintTransport)
+
+	// The context is canceled once the protocol is known, before the
+	// transport picks up the connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := ft.dial
+	ft.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ft.RoundTrip(req); err == nil {
+		t.Fatal("expected an error for a canceled request")
+	}
+
+	ft.mu.Lock()
+	pending := len(ft.pending)
+	ft.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("got %d pending connections", pending)
+	}
+}
+
+func TestValidateFingerprint(t *testing.T) {
+	for _, name := range []string{"", "go", "client", "chrome", "firefox"} {
+		if err := validateFingerprint(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if err := validateFingerprint("netscape"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
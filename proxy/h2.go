@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/buf"
+	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
+)
+
+// hopHeaders are connection-specific headers that must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// handleH2 serves an intercepted client connection that negotiated HTTP/2.
+// Every stream goes through the request and response rules on its own.
+func (p Server) handleH2(clientConn *tls.Conn, dst string, hello *clientHello) {
+	flow := p.pcap.newFlow(clientConn)
+	defer flow.close()
+
+	server := &http2.Server{}
+	server.ServeConn(clientConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p.isMagicHost(r.Host) {
+				resp := p.magicResponse(r, clientConn.LocalAddr())
+				defer resp.Body.Close()
+				writeResponse(w, resp)
+				return
+			}
+			p.serveH2Stream(w, r, dst, hello, flow)
+		}),
+	})
+}
+
+func (p Server) serveH2Stream(w http.ResponseWriter, r *http.Request, dst string, hello *clientHello, flow *pcapFlow) {
+	r.URL.Scheme = "https"
+	r.URL.Host = r.Host
+	r.RequestURI = ""
+
+	originalRequest := r.Clone(r.Context())
+
+	var resp *http.Response
+	err := applyRules(p.requestRules, r, nil)
+	var respond *rule.RespondError
+	if errors.As(err, &respond) {
+		resp = ruleResponse(r, respond.Response)
+		err = nil
+	}
+	if errors.Is(err, rule.ErrReset) {
+		// HTTP/2 resets the stream, other streams of the connection go on.
+		slog.Info("Resetting stream", slog.String("url", r.URL.String()), slog.String("err", err.Error()))
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		slog.Error("apply rules error", slog.String("err", err.Error()), slog.Any("request", r))
+		panic(http.ErrAbortHandler)
+	}
+
+	originalRequest.Body = r.Body
+
+	logger := slog.With(slog.String("id", uuid.NewString()), slog.String("url", r.URL.String()), slog.String("method", r.Method), slog.String("proto", r.Proto))
+	logger.Debug("Received request")
+
+	exchange := flow.begin(r)
+	defer exchange.end()
+
+	if resp != nil {
+		logger.Debug("Responding from rule", slog.Int("status", resp.StatusCode))
+		io.Copy(io.Discard, r.Body)
+	} else {
+		resp, err = p.transport.RoundTrip(upstreamRequest(r, requestDst(originalRequest, r, dst), hello))
+		if err != nil {
+			logger.Error("Failed to send request", slog.String("err", err.Error()))
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		logger.Debug("Received response", slog.Any("response", resp))
+	}
+	defer resp.Body.Close()
+
+	err = applyRules(p.responseRules, originalRequest, resp)
+	if errors.As(err, &respond) {
+		resp.Body.Close()
+		resp = ruleResponse(originalRequest, respond.Response)
+		defer resp.Body.Close()
+		err = nil
+	}
+	if errors.Is(err, rule.ErrReset) {
+		logger.Info("Resetting stream", slog.String("err", err.Error()))
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		logger.Error("apply rules error", slog.String("err", err.Error()))
+		panic(http.ErrAbortHandler)
+	}
+
+	exchange.response(resp)
+	err = writeResponse(w, resp)
+	if err != nil {
+		logger.Error("Failed to write response", slog.String("err", err.Error()))
+		panic(http.ErrAbortHandler)
+	}
+
+	logger.Debug("Sent response")
+}
+
+// writeResponse copies resp to w, flushing as data arrives so streaming
+// responses are not held back, and sends the trailers after the body.
+func writeResponse(w http.ResponseWriter, resp *http.Response) error {
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	removeHopHeaders(header)
+
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	buffer := buf.ByteGet(BufSize)
+	defer buf.BytePut(buffer)
+
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, werr := w.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, v := range resp.Trailer {
+		header[http.TrailerPrefix+k] = v
+	}
+
+	return nil
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		// "TE: trailers" is end-to-end and required by gRPC.
+		if h == "Te" && header.Get(h) == "trailers" {
+			continue
+		}
+		header.Del(h)
+	}
+}
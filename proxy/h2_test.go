@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// serveH2 runs handleH2 on one end of a pipe and returns an HTTP/2 client
+// connection on the other end.
+func serveH2(t *testing.T, p Server) *http2.ClientConn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		tlsConn := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{*p.getTlsCert("127.0.0.1")},
+			NextProtos:   []string{http2.NextProtoTLS},
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("server handshake: %v", err)
+			return
+		}
+		p.handleH2(tlsConn, "", nil)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.caCert)
+	tlsConn := tls.Client(client, &tls.Config{ServerName: "127.0.0.1", RootCAs: pool, NextProtos: []string{http2.NextProtoTLS}})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+
+	return cc
+}
+
+func TestHandleH2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Origin", "yes")
+		fmt.Fprintf(w, "%s %s %s proxy-authorization=%s te=%s body=%s",
+			r.Proto, r.Method, r.URL.Path, r.Header.Get("Proxy-Authorization"), r.Header.Get("Te"), body)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+	host := origin.Listener.Addr().String()
+
+	p := newRulesServer(t, `enabled: true
+rules:
+  - name: stub
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/stub'"
+    action: respond
+    status: 202
+    headers:
+      Keep-Alive: timeout=5
+      Proxy-Authenticate: Basic
+    body: stubbed
+  - name: reset
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/reset'"
+    action: reject
+    reset: true
+  - name: mark
+    enabled: true
+    change: response
+    rule: "true"
+    action: set_header
+    headers:
+      X-Proxied: "yes"
+`)
+	test := newTestServer(t, "")
+	p.caCert, p.caKey, p.certs, p.certFlight, p.leafKey, p.leafCert = test.caCert, test.caKey, test.certs, test.certFlight, test.leafKey, test.leafCert
+	p.upstreamTLS = []*UpstreamTLS{{Hosts: []string{"127.0.0.1"}, InsecureSkipVerify: true}}
+	if err := p.upstreamTLS[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	p.transport = p.newTransport()
+
+	cc := serveH2(t, p)
+	roundTrip := func(method, path, body string, header http.Header) (*http.Response, string, error) {
+		req, err := http.NewRequest(method, "https://"+host+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, string(data), err
+	}
+
+	resp, body, err := roundTrip("POST", "/echo", "hello", http.Header{"Proxy-Authorization": {"Basic Zm9vOmJhcg=="}, "Te": {"trailers"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "HTTP/2.0 POST /echo proxy-authorization= te=trailers body=hello"; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	if resp.Header.Get("X-Origin") != "yes" || resp.Header.Get("X-Proxied") != "yes" || resp.Header.Get("Proxy-Authenticate") != "" {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+
+	resp, body, err = roundTrip("GET", "/stub", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || body != "stubbed" || resp.Header.Get("X-Proxied") != "yes" {
+		t.Errorf("got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp.Header.Get("Keep-Alive") != "" || resp.Header.Get("Proxy-Authenticate") != "" {
+		t.Errorf("hop headers were sent: %v", resp.Header)
+	}
+
+	// A reset only ends its stream, the connection goes on.
+	if _, _, err = roundTrip("GET", "/reset", "", nil); err == nil {
+		t.Error("expected the stream to be reset")
+	}
+	if _, body, err = roundTrip("GET", "/after", "", nil); err != nil || body != "HTTP/2.0 GET /after proxy-authorization= te= body=" {
+		t.Errorf("got %q, %v after a reset", body, err)
+	}
+}
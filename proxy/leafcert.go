@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const defaultLeafValidity = 240 * time.Hour
+
+// minMirrorValidity is the shortest validity a mirrored certificate takes
+// over from the origin certificate.
+const minMirrorValidity = time.Hour
+
+// LeafCert configures the certificates forged for intercepted hosts.
+type LeafCert struct {
+	// ChainFile holds the intermediate certificates sent after the leaf.
+	ChainFile   string       `yaml:"chain_file"`
+	KeyType     string       `yaml:"key_type"`
+	Validity    string       `yaml:"validity"`
+	Subject     *LeafSubject `yaml:"subject"`
+	KeyUsage    []string     `yaml:"key_usage"`
+	ExtKeyUsage []string     `yaml:"ext_key_usage"`
+	// Wildcard makes sibling subdomains share a certificate for
+	// "*." + their parent domain.
+	Wildcard bool `yaml:"wildcard"`
+
+	chain       [][]byte
+	validity    time.Duration
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+	subject     map[string][]*template.Template
+	// hash identifies the settings certificates are minted with, so
+	// certificates cached on disk under other settings aren't reused.
+	hash string
+}
+
+// LeafSubject is the subject of forged certificates. Every value is a
+// template executed with the intercepted host as {{.Host}}.
+type LeafSubject struct {
+	CommonName         string   `yaml:"common_name"`
+	Organization       []string `yaml:"organization"`
+	OrganizationalUnit []string `yaml:"organizational_unit"`
+	Country            []string `yaml:"country"`
+	Province           []string `yaml:"province"`
+	Locality           []string `yaml:"locality"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// defaultLeafCert forges 10 day P-256 certificates for TLS servers.
+func defaultLeafCert() *LeafCert {
+	l := &LeafCert{}
+	if err := l.compile(); err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func (l *LeafCert) compile() error {
+	if l.KeyType == "" {
+		l.KeyType = "ecdsa"
+	}
+	if _, ok := keyGenerators[l.KeyType]; !ok {
+		return fmt.Errorf("unknown key type %q", l.KeyType)
+	}
+
+	l.validity = defaultLeafValidity
+	if l.Validity != "" {
+		validity, err := time.ParseDuration(l.Validity)
+		if err != nil {
+			return err
+		}
+		if validity <= 0 {
+			return fmt.Errorf("validity must be positive")
+		}
+		l.validity = validity
+	}
+
+	if l.KeyUsage == nil {
+		l.KeyUsage = []string{"digital_signature"}
+		if strings.HasPrefix(l.KeyType, "rsa") {
+			// TLS 1.2 RSA key exchange encrypts the premaster secret with the
+			// leaf key.
+			l.KeyUsage = append(l.KeyUsage, "key_encipherment")
+		}
+	}
+	l.keyUsage = 0
+	for _, name := range l.KeyUsage {
+		usage, ok := keyUsages[name]
+		if !ok {
+			return fmt.Errorf("unknown key usage %q", name)
+		}
+		l.keyUsage |= usage
+	}
+
+	if l.ExtKeyUsage == nil {
+		l.ExtKeyUsage = []string{"server_auth", "client_auth"}
+	}
+	l.extKeyUsage = make([]x509.ExtKeyUsage, 0, len(l.ExtKeyUsage))
+	for _, name := range l.ExtKeyUsage {
+		usage, ok := extKeyUsages[name]
+		if !ok {
+			return fmt.Errorf("unknown ext key usage %q", name)
+		}
+		l.extKeyUsage = append(l.extKeyUsage, usage)
+	}
+
+	if l.Subject == nil {
+		l.Subject = &LeafSubject{Organization: []string{"MITM proxy"}}
+	}
+	l.subject = make(map[string][]*template.Template)
+	fields := map[string][]string{
+		"common_name":         {l.Subject.CommonName},
+		"organization":        l.Subject.Organization,
+		"organizational_unit": l.Subject.OrganizationalUnit,
+		"country":             l.Subject.Country,
+		"province":            l.Subject.Province,
+		"locality":            l.Subject.Locality,
+	}
+	for field, values := range fields {
+		for _, value := range values {
+			t, err := template.New(field).Option("missingkey=error").Parse(value)
+			if err != nil {
+				return fmt.Errorf("subject %s: %v", field, err)
+			}
+			l.subject[field] = append(l.subject[field], t)
+		}
+	}
+
+	settings := fmt.Sprintf("%s|%s|%v|%v|%v|%q", l.KeyType, l.validity, l.keyUsage, l.extKeyUsage, l.Wildcard, *l.Subject)
+	sum := sha256.Sum256([]byte(settings))
+	l.hash = hex.EncodeToString(sum[:8])
+
+	l.chain = nil
+	if l.ChainFile != "" {
+		data, err := os.ReadFile(l.ChainFile)
+		if err != nil {
+			return err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if _, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return fmt.Errorf("chain_file: %v", err)
+			}
+			l.chain = append(l.chain, block.Bytes)
+		}
+		if len(l.chain) == 0 {
+			return fmt.Errorf("no certificates found in %s", l.ChainFile)
+		}
+	}
+
+	return nil
+}
+
+// certNames returns the names of the certificate forged for host, the first
+// one identifying it. In wildcard mode a host shares the certificate of its
+// parent domain, unless the parent is a public suffix such as "co.uk".
+func (l *LeafCert) certNames(host string) []string {
+	if !l.Wildcard || net.ParseIP(host) != nil {
+		return []string{host}
+	}
+
+	domain := host
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil && len(parent) >= len(site) {
+			domain = parent
+		}
+	}
+	if _, err := publicsuffix.EffectiveTLDPlusOne(domain); err != nil {
+		return []string{host}
+	}
+
+	return []string{"*." + domain, domain}
+}
+
+// template returns the certificate template for names, IP addresses going
+// into the IP SANs. The validity is capped at the expiry of the signing CA.
+func (l *LeafCert) template(names []string, ca *x509.Certificate) (*x509.Certificate, error) {
+	subject, err := l.executeSubject(names[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var dnsNames []string
+	var ips []net.IP
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+
+	notAfter := time.Now().Add(l.validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	return &x509.Certificate{
+		Subject:     subject,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		NotBefore:   time.Now(),
+		NotAfter:    notAfter,
+		KeyUsage:    l.keyUsage,
+		ExtKeyUsage: l.extKeyUsage,
+	}, nil
+}
+
+// mirrorTemplate returns the template of a certificate for host with the
+// SANs and subject common name of upstream. The certificate is valid for
+// the leaf validity, cut short at the expiry of upstream unless that is less
+// than minMirrorValidity away, and at the expiry of the signing CA. An
+// upstream certificate naming its host only in the common name gets host as
+// SAN, since clients ignore the common name.
+func (l *LeafCert) mirrorTemplate(host string, upstream, ca *x509.Certificate) (*x509.Certificate, error) {
+	subject, err := l.executeSubject(upstream.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	subject.CommonName = upstream.Subject.CommonName
+
+	now := time.Now()
+	notAfter := now.Add(l.validity)
+	// An origin certificate about to expire, or already expired, would make
+	// the mirrored one stale right away and minted again for every
+	// connection.
+	if upstream.NotAfter.Before(notAfter) && upstream.NotAfter.After(now.Add(minMirrorValidity)) {
+		notAfter = upstream.NotAfter
+	}
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+
+	dnsNames, ips := upstream.DNSNames, upstream.IPAddresses
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			dnsNames = []string{host}
+		}
+	}
+
+	return &x509.Certificate{
+		Subject:     subject,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		NotBefore:   now,
+		NotAfter:    notAfter,
+		KeyUsage:    l.keyUsage,
+		ExtKeyUsage: l.extKeyUsage,
+	}, nil
+}
+
+func (l *LeafCert) executeSubject(host string) (pkix.Name, error) {
+	values := make(map[string][]string, len(l.subject))
+	for field, templates := range l.subject {
+		for _, t := range templates {
+			var value strings.Builder
+			if err := t.Execute(&value, struct{ Host string }{host}); err != nil {
+				return pkix.Name{}, err
+			}
+			if value.Len() > 0 {
+				values[field] = append(values[field], value.String())
+			}
+		}
+	}
+
+	name := pkix.Name{
+		Organization:       values["organization"],
+		OrganizationalUnit: values["organizational_unit"],
+		Country:            values["country"],
+		Province:           values["province"],
+		Locality:           values["locality"],
+	}
+	if cn := values["common_name"]; len(cn) > 0 {
+		name.CommonName = cn[0]
+	}
+
+	return name, nil
+}
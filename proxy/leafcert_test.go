@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigLeafCert(t *testing.T) {
+	dir := t.TempDir()
+
+	intermediate, err := GenerateCA("Intermediate", "ecdsa", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	chainFile := filepath.Join(dir, "chain.pem")
+	if err = os.WriteFile(chainFile, intermediate.CertPEM(), 0o600); err != nil {
+		t.Fatalf("write chain: %v", err)
+	}
+
+	path := filepath.Join(dir, "proxy.yaml")
+	data := `leaf_cert:
+  chain_file: "` + chainFile + `"
+  key_type: rsa
+  validity: 48h
+  subject:
+    common_name: "{{.Host}}"
+    organization: ["Test Org"]
+    organizational_unit: ["proxy for {{.Host}}"]
+  ext_key_usage: [server_auth]
+`
+	if err = os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	p := newTestServer(t, "")
+	WithConfig(cfg)(&p)
+	p.leafKey, err = generateKey(p.leafCert.KeyType)
+	if err != nil {
+		t.Fatalf("generateKey: %v", err)
+	}
+	p.certs.chain = certChain(p.caCert, p.leafCert.chain)
+
+	tlsCert := p.getTlsCert("example.com:443")
+	if len(tlsCert.Certificate) != 2 || !intermediate.Cert.Equal(mustParseCertificate(t, tlsCert.Certificate[1])) {
+		t.Fatalf("expected the chain after the leaf, got %d certificates", len(tlsCert.Certificate))
+	}
+
+	leaf := tlsCert.Leaf
+	if leaf.Subject.CommonName != "example.com" || leaf.Subject.OrganizationalUnit[0] != "proxy for example.com" || leaf.Subject.Organization[0] != "Test Org" {
+		t.Errorf("unexpected subject %v", leaf.Subject)
+	}
+	if _, ok := leaf.PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("expected an RSA key, got %T", leaf.PublicKey)
+	}
+	if leaf.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("unexpected key usage %v", leaf.KeyUsage)
+	}
+	if len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("unexpected ext key usage %v", leaf.ExtKeyUsage)
+	}
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity != 48*time.Hour {
+		t.Errorf("unexpected validity %v", validity)
+	}
+}
+
+func TestCertChainAddsIntermediateCA(t *testing.T) {
+	root, err := GenerateCA("Root", "ecdsa", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+
+	if chain := certChain(root.Cert, nil); len(chain) != 0 {
+		t.Errorf("expected no chain for a root CA, got %d certificates", len(chain))
+	}
+
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), RawIssuer: []byte("root")}
+	chain := certChain(intermediate, [][]byte{root.Cert.Raw})
+	if len(chain) != 2 || string(chain[0]) != "intermediate" {
+		t.Errorf("expected the intermediate CA first, got %d certificates", len(chain))
+	}
+}
+
+func mustParseCertificate(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func TestLeafCertNames(t *testing.T) {
+	wildcard := &LeafCert{Wildcard: true}
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"www.example.com", []string{"*.example.com", "example.com"}},
+		{"example.com", []string{"*.example.com", "example.com"}},
+		{"a.cdn.example.com", []string{"*.cdn.example.com", "cdn.example.com"}},
+		{"shop.example.co.uk", []string{"*.example.co.uk", "example.co.uk"}},
+		{"co.uk", []string{"co.uk"}},
+		{"localhost", []string{"localhost"}},
+		{"192.0.2.1", []string{"192.0.2.1"}},
+		{"2001:db8::1", []string{"2001:db8::1"}},
+	}
+
+	for _, tt := range tests {
+		got := wildcard.certNames(tt.host)
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[len(got)-1] != tt.want[len(tt.want)-1] {
+			t.Errorf("certNames(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if got := (&LeafCert{}).certNames("www.example.com"); len(got) != 1 || got[0] != "www.example.com" {
+		t.Errorf("expected no wildcard by default, got %v", got)
+	}
+}
+
+func TestGetTlsCertIPAddress(t *testing.T) {
+	p := newTestServer(t, "")
+
+	leaf := p.getTlsCert("[2001:db8::1]:443").Leaf
+	if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "2001:db8::1" {
+		t.Errorf("expected an IP SAN, got DNS %v IP %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	textTemplate "text/template"
+
+	"github.com/google/uuid"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
+)
+
+// DefaultMagicHost is the host answered by the proxy itself with the CA
+// certificate and a PAC file.
+const DefaultMagicHost = "mitm.proxy"
+
+var installPage = template.Must(template.New("install").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>MITM Proxy CA</title>
+</head>
+<body>
+<h1>MITM Proxy CA</h1>
+<p>Install and trust this certificate authority to let the proxy intercept HTTPS traffic of this device.</p>
+<ul>
+<li><a href="/ca.pem">ca.pem</a> - PEM certificate for browsers, macOS and Linux</li>
+<li><a href="/ca.der">ca.der</a> - DER certificate for Android and Windows</li>
+<li><a href="/ca.mobileconfig">ca.mobileconfig</a> - configuration profile for iOS and macOS</li>
+<li><a href="/proxy.pac">proxy.pac</a> - proxy auto-config file</li>
+</ul>
+<h2>iOS</h2>
+<p>Open ca.mobileconfig in Safari, install the profile in Settings, then enable full trust for the certificate in Settings &gt; General &gt; About &gt; Certificate Trust Settings.</p>
+<h2>Android</h2>
+<p>Download ca.der and install it in Settings &gt; Security &gt; Encryption &amp; credentials &gt; Install a certificate &gt; CA certificate. Apps only trust user CAs when their network security config allows it.</p>
+<h2>Windows</h2>
+<p>Open ca.der and install it in the Trusted Root Certification Authorities store.</p>
+<h2>macOS and Linux</h2>
+<p>See the installation guide for trusting ca.pem.</p>
+<p>Certificate SHA-256 fingerprint: <code>{{.Fingerprint}}</code></p>
+</body>
+</html>
+`))
+
+var mobileConfig = textTemplate.Must(textTemplate.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ca.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>proxy.mitm.ca.{{.CertUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{.Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>proxy.mitm.{{.UUID}}</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.UUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+var pacFile = textTemplate.Must(textTemplate.New("pac").Parse(`function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host === "localhost" || host === "127.0.0.1") {
+		return "DIRECT";
+	}
+	return "PROXY {{.}}; DIRECT";
+}
+`))
+
+// WithMagicHost makes the proxy answer requests to host itself, serving an
+// install page, the CA certificate and a PAC file pointing at proxyAddr.
+// An empty host disables it.
+func WithMagicHost(host, proxyAddr string) Option {
+	return func(s *Server) {
+		s.magicHost = strings.ToLower(host)
+		s.proxyAddr = proxyAddr
+	}
+}
+
+// isMagicHost reports whether host, with or without a port, is the magic
+// host.
+func (p Server) isMagicHost(host string) bool {
+	if p.magicHost == "" {
+		return false
+	}
+
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+
+	return strings.EqualFold(name, p.magicHost)
+}
+
+// magicResponse answers a request to the magic host. localAddr is the proxy
+// address the client connected to, used in the PAC file when the proxy
+// listens on all interfaces.
+func (p Server) magicResponse(r *http.Request, localAddr net.Addr) *http.Response {
+	var body bytes.Buffer
+	var contentType string
+	var err error
+
+	switch r.URL.Path {
+	case "/", "/index.html":
+		contentType = "text/html; charset=utf-8"
+		fingerprint := sha256.Sum256(p.caCert.Raw)
+		err = installPage.Execute(&body, struct{ Fingerprint string }{strings.ToUpper(hex.EncodeToString(fingerprint[:]))})
+	case "/ca.pem", "/ca.crt":
+		contentType = "application/x-pem-file"
+		err = pem.Encode(&body, &pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw})
+	case "/ca.der", "/ca.cer":
+		contentType = "application/x-x509-ca-cert"
+		body.Write(p.caCert.Raw)
+	case "/ca.mobileconfig":
+		contentType = "application/x-apple-aspen-config"
+		err = mobileConfig.Execute(&body, struct {
+			Name, Cert, UUID, CertUUID string
+		}{
+			Name:     p.caCert.Subject.CommonName,
+			Cert:     base64.StdEncoding.EncodeToString(p.caCert.Raw),
+			UUID:     uuid.NewSHA1(uuid.NameSpaceOID, p.caCert.Raw).String(),
+			CertUUID: uuid.NewSHA1(uuid.NameSpaceX500, p.caCert.Raw).String(),
+		})
+	case "/proxy.pac":
+		contentType = "application/x-ns-proxy-autoconfig"
+		err = pacFile.Execute(&body, p.pacProxyAddr(localAddr))
+	default:
+		return rule.NewResponse(r, http.StatusNotFound, plainText(), http.StatusText(http.StatusNotFound))
+	}
+
+	if err != nil {
+		return rule.NewResponse(r, http.StatusInternalServerError, plainText(), err.Error())
+	}
+
+	return rule.NewResponse(r, http.StatusOK, http.Header{
+		"Content-Type":  {contentType},
+		"Cache-Control": {"no-store"},
+	}, body.String())
+}
+
+// plainText returns the header of a plain text response.
+func plainText() http.Header {
+	return http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+}
+
+// pacProxyAddr returns the address clients should use to reach the proxy,
+// replacing an unspecified listen host with the address the client reached.
+func (p Server) pacProxyAddr(localAddr net.Addr) string {
+	host, port, err := net.SplitHostPort(p.proxyAddr)
+	if err != nil {
+		return p.proxyAddr
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if tcpAddr, ok := localAddr.(*net.TCPAddr); ok {
+			host = tcpAddr.IP.String()
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMagicResponse(t *testing.T) {
+	p := newTestServer(t, "")
+	WithMagicHost("MITM.proxy", "0.0.0.0:9999")(&p)
+
+	if !p.isMagicHost("mitm.PROXY:443") || p.isMagicHost("example.com") {
+		t.Fatal("unexpected magic host match")
+	}
+
+	get := func(path string) (*http.Response, []byte) {
+		r := &http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "http", Host: "mitm.proxy", Path: path}}
+		resp := p.magicResponse(r, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9999})
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("/ca.der")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, p.caCert.Raw) {
+		t.Errorf("unexpected /ca.der response %d", resp.StatusCode)
+	}
+
+	resp, body = get("/proxy.pac")
+	if resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" || !strings.Contains(string(body), `"PROXY 192.0.2.1:9999; DIRECT"`) {
+		t.Errorf("unexpected PAC file %q", body)
+	}
+
+	resp, _ = get("/missing")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/buf"
+	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
+)
+
+const (
+	// handshakeFailureTTL is how long the handshake failures of a host are
+	// remembered after the last one. A host passed through is intercepted
+	// again once they expire.
+	handshakeFailureTTL = time.Hour
+	// maxHandshakeFailureHosts bounds the hosts handshake failures are
+	// counted for.
+	maxHandshakeFailureHosts = 10000
+)
+
+// certRejectionAlerts are the TLS alerts of a client rejecting the forged
+// certificate, as crypto/tls words them.
+var certRejectionAlerts = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unsupported certificate":       true,
+	"tls: revoked certificate":           true,
+	"tls: expired certificate":           true,
+	"tls: unknown certificate":           true,
+	"tls: unknown certificate authority": true,
+}
+
+// Passthrough selects TLS streams that are tunneled to the origin without
+// interception, such as certificate-pinned apps.
+type Passthrough struct {
+	Hosts []string `yaml:"hosts"`
+	// Rule is a CEL expression evaluated with the CONNECT request as req.
+	Rule string `yaml:"rule"`
+	// AutoAfterFailures passes a host through once that many consecutive
+	// client handshakes for it were rejected with a certificate alert.
+	// Zero disables the detection.
+	AutoAfterFailures int `yaml:"auto_after_failures"`
+
+	condition *rule.Rule
+	mu        sync.Mutex
+	failures  map[string]*handshakeFailures
+}
+
+// handshakeFailures counts the consecutive certificate rejections of a host.
+type handshakeFailures struct {
+	count int
+	last  time.Time
+}
+
+func (t *Passthrough) compile(envs map[string]string) error {
+	if t.Rule == "" {
+		return nil
+	}
+
+	condition, err := rule.NewCondition("passthrough", t.Rule, envs)
+	if err != nil {
+		return err
+	}
+	t.condition = condition
+
+	return nil
+}
+
+// match reports whether the TLS stream for host should be passed through,
+// and the reason for the decision.
+func (t *Passthrough) match(connectReq *http.Request, host string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	if matchHosts(t.Hosts, host) {
+		return "host", true
+	}
+
+	if t.AutoAfterFailures > 0 && t.failedTooOften(host) {
+		return "handshake failures", true
+	}
+
+	if t.condition != nil {
+		if connectReq == nil {
+			connectReq = &http.Request{
+				Method: http.MethodConnect,
+				URL:    &url.URL{Host: host},
+				Host:   host,
+				Header: http.Header{},
+			}
+		}
+
+		ok, err := t.condition.Check(connectReq, nil)
+		if err != nil {
+			slog.Error("Failed to check passthrough rule", slog.String("host", host), slog.String("err", err.Error()))
+			return "", false
+		}
+		if ok {
+			return "rule", true
+		}
+	}
+
+	return "", false
+}
+
+// failedTooOften reports whether the client handshakes for host were
+// rejected AutoAfterFailures times in a row, forgetting expired failures.
+func (t *Passthrough) failedTooOften(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[host]
+	if !ok {
+		return false
+	}
+	if time.Since(f.last) > handshakeFailureTTL {
+		delete(t.failures, host)
+		return false
+	}
+
+	return f.count >= t.AutoAfterFailures
+}
+
+// handshakeFailed records a failed client handshake for host. Only a client
+// rejecting the certificate counts, not aborted or garbled handshakes.
+func (t *Passthrough) handshakeFailed(host string, err error) {
+	if t == nil || t.AutoAfterFailures <= 0 || !isCertRejection(err) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	f, ok := t.failures[host]
+	if !ok || now.Sub(f.last) > handshakeFailureTTL {
+		if t.failures == nil {
+			t.failures = make(map[string]*handshakeFailures)
+		}
+		if !ok && len(t.failures) >= maxHandshakeFailureHosts {
+			t.evictFailures(now)
+		}
+		f = &handshakeFailures{}
+		t.failures[host] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count == t.AutoAfterFailures {
+		slog.Info("Passing host through after repeated certificate rejections", slog.String("host", host), slog.Int("failures", f.count))
+	}
+}
+
+// handshakeSucceeded forgets the failures of host, which accepted the
+// certificate.
+func (t *Passthrough) handshakeSucceeded(host string) {
+	if t == nil || t.AutoAfterFailures <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, host)
+}
+
+// evictFailures drops expired failures, and the oldest one when none
+// expired. t.mu must be held.
+func (t *Passthrough) evictFailures(now time.Time) {
+	var oldest string
+	for host, f := range t.failures {
+		if now.Sub(f.last) > handshakeFailureTTL {
+			delete(t.failures, host)
+		} else if oldest == "" || f.last.Before(t.failures[oldest].last) {
+			oldest = host
+		}
+	}
+	if len(t.failures) >= maxHandshakeFailureHosts {
+		delete(t.failures, oldest)
+	}
+}
+
+// isCertRejection reports whether err is a TLS alert of the peer rejecting
+// the certificate.
+func isCertRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+
+	return certRejectionAlerts[opErr.Err.Error()]
+}
+
+// tunnel passes the raw client stream through to addr.
+func (p Server) tunnel(clientConn net.Conn, addr string) {
+	extConn, err := p.dialer.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to dial remote host: %v", err), slog.String("addr", addr))
+		return
+	}
+	defer extConn.Close()
+
+	if err = pipe(clientConn, extConn); err != nil {
+		slog.Debug("Passthrough tunnel closed", slog.String("addr", addr), slog.String("err", err.Error()))
+	}
+}
+
+// pipe copies data in both directions until either side is done.
+func pipe(client, upstream io.ReadWriter) error {
+	errChan := make(chan error, 2)
+	copyConn := func(a io.Writer, b io.Reader) {
+		buffer := buf.ByteGet(BufSize)
+		defer buf.BytePut(buffer)
+		_, err := io.CopyBuffer(a, b, buffer)
+		errChan <- err
+	}
+
+	go copyConn(client, upstream)
+	go copyConn(upstream, client)
+
+	return <-errChan
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPassthroughMatch(t *testing.T) {
+	pt := &Passthrough{
+		Hosts:             []string{".bank.example"},
+		Rule:              "req.Host.startsWith('pinned.')",
+		AutoAfterFailures: 2,
+	}
+	if err := pt.compile(nil); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if reason, ok := pt.match(nil, "www.bank.example"); !ok || reason != "host" {
+		t.Errorf("expected host match, got %q %v", reason, ok)
+	}
+
+	connectReq := &http.Request{Method: http.MethodConnect, Host: "pinned.app.example:443", URL: &url.URL{Host: "pinned.app.example:443"}, Header: http.Header{}}
+	if reason, ok := pt.match(connectReq, "pinned.app.example"); !ok || reason != "rule" {
+		t.Errorf("expected rule match, got %q %v", reason, ok)
+	}
+
+	if _, ok := pt.match(nil, "flaky.example"); ok {
+		t.Fatal("expected no match before handshake failures")
+	}
+	rejected := rejectedHandshake(t)
+	pt.handshakeFailed("flaky.example", rejected)
+	if _, ok := pt.match(nil, "flaky.example"); ok {
+		t.Fatal("expected no match after a single handshake failure")
+	}
+	pt.handshakeFailed("flaky.example", rejected)
+	if reason, ok := pt.match(nil, "flaky.example"); !ok || reason != "handshake failures" {
+		t.Errorf("expected match after handshake failures, got %q %v", reason, ok)
+	}
+
+	var disabled *Passthrough
+	if _, ok := disabled.match(nil, "www.bank.example"); ok {
+		t.Error("nil passthrough must not match")
+	}
+}
+
+func TestPassthroughFailures(t *testing.T) {
+	pt := &Passthrough{AutoAfterFailures: 2}
+	rejected := rejectedHandshake(t)
+
+	// Aborted handshakes don't count.
+	for _, err := range []error{io.EOF, errors.New("tls: first record does not look like a TLS handshake")} {
+		pt.handshakeFailed("aborted.example", err)
+		pt.handshakeFailed("aborted.example", err)
+	}
+	if _, ok := pt.match(nil, "aborted.example"); ok {
+		t.Error("expected aborted handshakes not to count")
+	}
+
+	// A successful handshake resets the count.
+	pt.handshakeFailed("reset.example", rejected)
+	pt.handshakeSucceeded("reset.example")
+	pt.handshakeFailed("reset.example", rejected)
+	if _, ok := pt.match(nil, "reset.example"); ok {
+		t.Error("expected a successful handshake to reset the failures")
+	}
+
+	// Failures expire, and the host is intercepted again.
+	pt.handshakeFailed("expired.example", rejected)
+	pt.handshakeFailed("expired.example", rejected)
+	if _, ok := pt.match(nil, "expired.example"); !ok {
+		t.Fatal("expected a match after handshake failures")
+	}
+	pt.mu.Lock()
+	pt.failures["expired.example"].last = time.Now().Add(-handshakeFailureTTL - time.Second)
+	pt.mu.Unlock()
+	if _, ok := pt.match(nil, "expired.example"); ok {
+		t.Error("expected expired failures to be forgotten")
+	}
+	pt.handshakeFailed("expired.example", rejected)
+	if _, ok := pt.match(nil, "expired.example"); ok {
+		t.Error("expected expired failures not to count")
+	}
+
+	// The hosts are bounded, dropping the oldest.
+	pt.mu.Lock()
+	pt.failures = make(map[string]*handshakeFailures)
+	for i := 0; i < maxHandshakeFailureHosts; i++ {
+		pt.failures[fmt.Sprintf("host%d.example", i)] = &handshakeFailures{count: 1, last: time.Now().Add(time.Duration(i) * time.Millisecond)}
+	}
+	pt.mu.Unlock()
+	pt.handshakeFailed("new.example", rejected)
+	pt.mu.Lock()
+	_, oldest := pt.failures["host0.example"]
+	size := len(pt.failures)
+	pt.mu.Unlock()
+	if size != maxHandshakeFailureHosts || oldest {
+		t.Errorf("got %d hosts, oldest kept %v", size, oldest)
+	}
+}
+
+// rejectedHandshake returns the error of a server handshake with a client
+// that doesn't trust the certificate.
+func rejectedHandshake(t *testing.T) error {
+	t.Helper()
+
+	p := newTestServer(t, "")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: "pinned.example"}).Handshake()
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	err = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{*p.getTlsCert("pinned.example")}}).Handshake()
+	if !isCertRejection(err) {
+		t.Fatalf("expected a certificate rejection, got %v", err)
+	}
+
+	return err
+}
@@ -0,0 +1,469 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapLinkTypeEthernet  = 1
+	pcapMaxSegment        = 1460
+	pcapServerPort        = 80
+	tcpFlagFin            = 0x01
+	tcpFlagSyn            = 0x02
+	tcpFlagPsh            = 0x08
+	tcpFlagAck            = 0x10
+	ethernetHeaderLen     = 14
+	ipv4HeaderLen         = 20
+	tcpHeaderLen          = 20
+	etherTypeIPv4         = 0x0800
+	ipProtocolTCP         = 6
+	pcapSyntheticClientIP = "10.0.0.1"
+	// pcapMaxBody is the most of a body recorded per message.
+	pcapMaxBody = 4 << 20
+	// pcapBodyWait is how long the record of an exchange waits for the
+	// transport to finish reading the request body.
+	pcapBodyWait = time.Second
+	// pcapTruncatedHeader marks a recorded message whose body is cut short,
+	// because it was longer than pcapMaxBody or not read to the end.
+	pcapTruncatedHeader = "X-Pcap-Truncated"
+)
+
+var pcapServerIP = net.IPv4(10, 0, 0, 2).To4()
+
+// pcapWriter writes the decrypted HTTP exchanges of every intercepted client
+// connection to its own pcapng file in dir. The exchanges are written as
+// HTTP/1.1 over a synthetic TCP connection to port 80, whatever protocol
+// the client used, so Wireshark dissects them as plain HTTP.
+type pcapWriter struct {
+	dir   string
+	flows atomic.Int64
+}
+
+// pcapFlow is the synthetic TCP connection of one client connection. The
+// file is created when the first exchange completes.
+type pcapFlow struct {
+	w          *pcapWriter
+	clientIP   net.IP
+	clientPort uint16
+
+	mu        sync.Mutex
+	file      *os.File
+	out       *bufio.Writer
+	clientSeq uint32
+	serverSeq uint32
+}
+
+// pcapExchange collects a request and its response while they stream
+// through the proxy.
+type pcapExchange struct {
+	flow     *pcapFlow
+	start    time.Time
+	req      *http.Request
+	reqBody  *pcapBody
+	resp     *http.Response
+	respTime time.Time
+	respBody *pcapBody
+}
+
+// pcapBody records up to pcapMaxBody bytes of a body. The transport may
+// still read a request body while the exchange ends, so the buffer is
+// guarded by mu.
+type pcapBody struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	done      chan struct{}
+	finish    sync.Once
+}
+
+// WithPcapDir writes the decrypted HTTP exchanges of every intercepted
+// client connection to a pcapng file in dir.
+func WithPcapDir(dir string) Option {
+	return func(s *Server) {
+		s.pcapDir = dir
+	}
+}
+
+func newPcapWriter(dir string) (*pcapWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &pcapWriter{dir: dir}, nil
+}
+
+// newFlow starts the capture of the client connection conn.
+func (w *pcapWriter) newFlow(conn net.Conn) *pcapFlow {
+	if w == nil {
+		return nil
+	}
+
+	flow := &pcapFlow{w: w, clientIP: net.ParseIP(pcapSyntheticClientIP).To4(), clientPort: 1024}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			flow.clientIP = ip
+		}
+		flow.clientPort = uint16(addr.Port)
+	}
+
+	return flow
+}
+
+// begin starts recording an exchange, teeing the body of r as it is sent.
+func (f *pcapFlow) begin(r *http.Request) *pcapExchange {
+	if f == nil {
+		return nil
+	}
+
+	x := &pcapExchange{flow: f, start: time.Now(), req: r}
+	if r.Body != nil && r.Body != http.NoBody {
+		x.reqBody = newPcapBody()
+		r.Body = &pcapTee{rc: r.Body, body: x.reqBody}
+	}
+
+	return x
+}
+
+// response records resp, teeing its body as it is written to the client.
+func (x *pcapExchange) response(resp *http.Response) {
+	if x == nil {
+		return
+	}
+
+	x.resp = resp
+	x.respTime = time.Now()
+	// The body of a protocol switch is the upgraded connection, which is
+	// not recorded.
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil && resp.Body != http.NoBody {
+		x.respBody = newPcapBody()
+		resp.Body = &pcapTee{rc: resp.Body, body: x.respBody}
+	}
+}
+
+// end writes the exchange to the capture file. It waits up to
+// pcapBodyWait for the request body to be read to the end or closed.
+func (x *pcapExchange) end() {
+	if x == nil {
+		return
+	}
+
+	var request bytes.Buffer
+	req := x.req.Clone(x.req.Context())
+	reqBody, complete := x.reqBody.bytes(pcapBodyWait)
+	if !complete {
+		req.Header.Set(pcapTruncatedHeader, "true")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	req.ContentLength = int64(len(reqBody))
+	req.TransferEncoding = nil
+	if req.ContentLength == 0 {
+		req.Body = nil
+	}
+	req.Write(&request)
+
+	var response bytes.Buffer
+	if x.resp != nil {
+		resp := *x.resp
+		resp.Header = x.resp.Header.Clone()
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		respBody, complete := x.respBody.bytes(0)
+		if !complete {
+			resp.Header.Set(pcapTruncatedHeader, "true")
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		resp.ContentLength = int64(len(respBody))
+		resp.TransferEncoding = nil
+		resp.Trailer = nil
+		resp.Write(&response)
+	}
+
+	if err := x.flow.write(x.req.Host, x.start, request.Bytes(), x.respTime, response.Bytes()); err != nil {
+		slog.Warn("Failed to write pcap", slog.String("err", err.Error()))
+	}
+}
+
+// close finishes the synthetic connection and closes the capture file.
+func (f *pcapFlow) close() {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return
+	}
+
+	now := time.Now()
+	f.segment(now, true, tcpFlagFin|tcpFlagAck, nil)
+	f.segment(now, false, tcpFlagFin|tcpFlagAck, nil)
+	f.segment(now, true, tcpFlagAck, nil)
+
+	if err := f.out.Flush(); err != nil {
+		slog.Warn("Failed to write pcap", slog.String("file", f.file.Name()), slog.String("err", err.Error()))
+	}
+	f.file.Close()
+}
+
+func (f *pcapFlow) write(host string, reqTime time.Time, request []byte, respTime time.Time, response []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(host, reqTime); err != nil {
+			return err
+		}
+	}
+
+	for len(request) > 0 {
+		n := min(len(request), pcapMaxSegment)
+		f.segment(reqTime, true, tcpFlagPsh|tcpFlagAck, request[:n])
+		request = request[n:]
+	}
+	for len(response) > 0 {
+		n := min(len(response), pcapMaxSegment)
+		f.segment(respTime, false, tcpFlagPsh|tcpFlagAck, response[:n])
+		response = response[n:]
+	}
+
+	return f.out.Flush()
+}
+
+// open creates the capture file, writes the pcapng headers and the TCP
+// handshake.
+func (f *pcapFlow) open(host string, t time.Time) error {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, host)
+	name = fmt.Sprintf("%s-%d-%s.pcapng", t.Format("20060102T150405"), f.w.flows.Add(1), name)
+
+	file, err := os.OpenFile(filepath.Join(f.w.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.out = bufio.NewWriter(file)
+
+	// Section header block without options.
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+	f.out.Write(shb)
+
+	// Interface description block, timestamps in microseconds.
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapLinkTypeEthernet)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+	f.out.Write(idb)
+
+	f.clientSeq = 1000
+	f.serverSeq = 5000
+	f.segment(t, true, tcpFlagSyn, nil)
+	f.segment(t, false, tcpFlagSyn|tcpFlagAck, nil)
+	f.segment(t, true, tcpFlagAck, nil)
+
+	return nil
+}
+
+// segment writes one TCP segment of the synthetic connection and advances
+// the sequence number of its sender.
+func (f *pcapFlow) segment(t time.Time, fromClient bool, flags byte, payload []byte) {
+	srcIP, dstIP := f.clientIP, pcapServerIP
+	srcPort, dstPort := f.clientPort, uint16(pcapServerPort)
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagSyn != 0 && flags&tcpFlagAck == 0 {
+		ack = 0
+	}
+
+	packet := make([]byte, ethernetHeaderLen+ipv4HeaderLen+tcpHeaderLen+len(payload))
+
+	eth := packet[:ethernetHeaderLen]
+	copy(eth[0:6], []byte{0x02, 0, 0, 0, 0, 2})
+	copy(eth[6:12], []byte{0x02, 0, 0, 0, 0, 1})
+	if !fromClient {
+		eth[5], eth[11] = 1, 2
+	}
+	binary.BigEndian.PutUint16(eth[12:], etherTypeIPv4)
+
+	ip := packet[ethernetHeaderLen : ethernetHeaderLen+ipv4HeaderLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+tcpHeaderLen+len(payload)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = ipProtocolTCP
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := packet[ethernetHeaderLen+ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[tcpHeaderLen:], payload)
+
+	// The TCP checksum covers a pseudo header with the addresses.
+	pseudo := uint32(0)
+	for i := 0; i < 4; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(srcIP[i:])) + uint32(binary.BigEndian.Uint16(dstIP[i:]))
+	}
+	pseudo += ipProtocolTCP + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	// SYN and FIN take up a sequence number each.
+	advance := uint32(len(payload))
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		advance++
+	}
+	if fromClient {
+		f.clientSeq += advance
+	} else {
+		f.serverSeq += advance
+	}
+
+	f.writePacket(t, packet)
+}
+
+func (f *pcapFlow) writePacket(t time.Time, packet []byte) {
+	padded := (len(packet) + 3) &^ 3
+	block := make([]byte, 28+padded+4)
+	micros := uint64(t.UnixMicro())
+
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[8:], 0)
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	copy(block[28:], packet)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(block)))
+
+	f.out.Write(block)
+}
+
+// checksum returns the internet checksum of data, starting from sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+func newPcapBody() *pcapBody {
+	return &pcapBody{done: make(chan struct{})}
+}
+
+func (b *pcapBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n := pcapMaxBody - b.buf.Len(); len(p) > n {
+		b.buf.Write(p[:n])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (b *pcapBody) close() {
+	b.finish.Do(func() { close(b.done) })
+}
+
+// bytes returns a copy of the recorded body once it was read to the end or
+// closed, waiting at most wait. complete is false when the body was
+// truncated or is still being read.
+func (b *pcapBody) bytes(wait time.Duration) (data []byte, complete bool) {
+	if b == nil {
+		return nil, true
+	}
+
+	finished := true
+	select {
+	case <-b.done:
+	default:
+		timer := time.NewTimer(wait)
+		select {
+		case <-b.done:
+		case <-timer.C:
+			finished = false
+		}
+		timer.Stop()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return bytes.Clone(b.buf.Bytes()), finished && !b.truncated
+}
+
+// pcapTee records a body as it is read.
+type pcapTee struct {
+	rc   io.ReadCloser
+	body *pcapBody
+}
+
+func (t *pcapTee) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		t.body.Write(p[:n])
+	}
+	if err == io.EOF {
+		t.body.close()
+	}
+
+	return n, err
+}
+
+func (t *pcapTee) Close() error {
+	err := t.rc.Close()
+	t.body.close()
+
+	return err
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
+)
+
+func TestPcapFlow(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newPcapWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	flow := w.newFlow(server)
+
+	body := strings.Repeat("a", 3000)
+	r, err := http.NewRequest(http.MethodPost, "https://example.com/upload", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := flow.begin(r)
+	if _, err = io.ReadAll(r.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp := rule.NewResponse(r, http.StatusOK, plainText(), body)
+	x.response(resp)
+	if _, err = io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	x.end()
+	flow.close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-example.com.pcapng"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v (%v)", files, err)
+	}
+	packets, payload := readPcap(t, files[0])
+
+	// Handshake, one request segment, three response segments and the close.
+	if packets != 3+1+3+3 {
+		t.Errorf("got %d packets", packets)
+	}
+	for _, want := range []string{"POST /upload HTTP/1.1\r\n", "Content-Length: 5\r\n\r\nhello", "HTTP/1.1 200 OK\r\n", body} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("payload is missing %q", want)
+		}
+	}
+}
+
+func TestPcapBodies(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newPcapWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	flow := w.newFlow(server)
+
+	// The request body is still read by another goroutine when the exchange
+	// ends, and the response body is longer than recorded.
+	pr, pw := io.Pipe()
+	r, err := http.NewRequest(http.MethodPost, "https://example.com/upload", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := flow.begin(r)
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+	}()
+	go func() {
+		pw.Write([]byte("hello"))
+		time.Sleep(50 * time.Millisecond)
+		pw.Close()
+	}()
+	resp := rule.NewResponse(r, http.StatusOK, nil, strings.Repeat("a", pcapMaxBody+10))
+	x.response(resp)
+	if _, err = io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	x.end()
+	<-read
+	flow.close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-example.com.pcapng"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v (%v)", files, err)
+	}
+	_, payload := readPcap(t, files[0])
+
+	request, response, _ := strings.Cut(payload, "HTTP/1.1 200 OK\r\n")
+	if !strings.Contains(request, "Content-Length: 5\r\n") || !strings.HasSuffix(request, "\r\n\r\nhello") || strings.Contains(request, pcapTruncatedHeader) {
+		t.Errorf("unexpected request %q", request)
+	}
+	if !strings.Contains(response, fmt.Sprintf("Content-Length: %d\r\n", pcapMaxBody)) || !strings.Contains(response, pcapTruncatedHeader+": true\r\n") {
+		t.Errorf("unexpected response headers %q", response[:min(len(response), 200)])
+	}
+
+	// A body that is never finished is recorded as far as it was read.
+	body := newPcapBody()
+	body.Write([]byte("part"))
+	if data, complete := body.bytes(10 * time.Millisecond); string(data) != "part" || complete {
+		t.Errorf("got %q, complete %v", data, complete)
+	}
+}
+
+// readPcap checks the blocks of a capture file and returns the number of
+// packets and their payload.
+func readPcap(t *testing.T, file string) (int, string) {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.LittleEndian.Uint32(data) != pcapngSectionHeader || binary.LittleEndian.Uint32(data[8:]) != pcapngByteOrderMagic {
+		t.Fatalf("bad section header")
+	}
+
+	var packets int
+	var payload bytes.Buffer
+	for off := 0; off < len(data); {
+		blockType := binary.LittleEndian.Uint32(data[off:])
+		length := int(binary.LittleEndian.Uint32(data[off+4:]))
+		if length%4 != 0 || binary.LittleEndian.Uint32(data[off+length-4:]) != uint32(length) {
+			t.Fatalf("bad block length %d at %d", length, off)
+		}
+		if blockType == pcapngEnhancedPacket {
+			packets++
+			capLen := int(binary.LittleEndian.Uint32(data[off+20:]))
+			packet := data[off+28 : off+28+capLen]
+			ip := packet[ethernetHeaderLen:]
+			if checksum(ip[:ipv4HeaderLen], 0) != 0 {
+				t.Errorf("bad IP checksum in packet %d", packets)
+			}
+			payload.Write(ip[ipv4HeaderLen+tcpHeaderLen:])
+		}
+		off += length
+	}
+
+	return packets, payload.String()
+}
@@ -2,16 +2,22 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/eugene-ivanov-hash/mitm-proxy/buf"
 	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
@@ -22,28 +28,155 @@ const (
 )
 
 type Server struct {
-	caCert        *x509.Certificate
-	caKey         any
-	requestRules  []*rule.Rule
-	responseRules []*rule.Rule
+	caCert         *x509.Certificate
+	caKey          any
+	requestRules   []*rule.Rule
+	responseRules  []*rule.Rule
+	dialer         Dialer
+	transport      http.RoundTripper
+	clientTLS      *ClientTLS
+	upstreamTLS    []*UpstreamTLS
+	passthrough    *Passthrough
+	mirrorCerts    bool
+	certs          *certCache
+	certFlight     *singleflight.Group
+	leafKey        crypto.Signer
+	leafCert       *LeafCert
+	certCacheSize  int
+	certCacheDir   string
+	certStore      *certStore
+	certStoreDir   string
+	magicHost      string
+	proxyAddr      string
+	keyLog         io.Writer
+	tlsFingerprint string
+	pcap           *pcapWriter
+	pcapDir        string
+	socksUser      string
+	socksPassword  string
 }
 
-func NewProxySslServer(rootCa, rootKey string, requestRules []*rule.Rule, responseRules []*rule.Rule) *Server {
+type Option func(*Server)
+
+// WithDialer sets the dialer used for all outbound connections.
+func WithDialer(dialer Dialer) Option {
+	return func(s *Server) {
+		s.dialer = dialer
+	}
+}
+
+// WithSOCKS5Auth requires SOCKS5 clients to authenticate with the given
+// username and password.
+func WithSOCKS5Auth(user, password string) Option {
+	return func(s *Server) {
+		s.socksUser = user
+		s.socksPassword = password
+	}
+}
+
+// WithMirroredCerts makes forged certificates copy the SANs and subject
+// common name of the origin's certificate, and expire no later than it.
+func WithMirroredCerts() Option {
+	return func(s *Server) {
+		s.mirrorCerts = true
+	}
+}
+
+// WithCertCache limits the number of forged certificates kept in memory and,
+// when dir is not empty, persists them to dir so they survive restarts.
+func WithCertCache(size int, dir string) Option {
+	return func(s *Server) {
+		s.certCacheSize = size
+		s.certCacheDir = dir
+	}
+}
+
+// WithCertStore presents the certificates found in dir for the hosts they
+// cover instead of forging certificates. The directory is reloaded when its
+// files change.
+func WithCertStore(dir string) Option {
+	return func(s *Server) {
+		s.certStoreDir = dir
+	}
+}
+
+// WithKeyLog writes the TLS secrets of client and upstream connections to w
+// in the NSS key log format, letting Wireshark decrypt captured traffic.
+func WithKeyLog(w io.Writer) Option {
+	return func(s *Server) {
+		s.keyLog = w
+	}
+}
+
+func NewProxySslServer(rootCa, rootKey string, requestRules []*rule.Rule, responseRules []*rule.Rule, opts ...Option) *Server {
 	caCert, caKey, err := loadX509KeyPair(rootCa, rootKey)
 	if err != nil {
 		log.Fatal("Error loading CA certificate/key:", err)
 	}
 	log.Printf("loaded CA certificate and key; IsCA=%v\n", caCert.IsCA)
-	return &Server{
+	s := &Server{
 		caCert:        caCert,
 		caKey:         caKey,
 		requestRules:  requestRules,
 		responseRules: responseRules,
+		dialer:        &net.Dialer{},
+		clientTLS:     defaultClientTLS(),
+		leafCert:      defaultLeafCert(),
+		certFlight:    &singleflight.Group{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err = validateFingerprint(s.tlsFingerprint); err != nil {
+		log.Fatal("Error configuring TLS fingerprint:", err)
+	}
+	s.leafKey, err = generateKey(s.leafCert.KeyType)
+	if err != nil {
+		log.Fatal("Error generating leaf key:", err)
+	}
+	s.certs, err = newCertCache(s.certCacheSize, s.certCacheDir, s.leafCert.hash, caCert, certChain(caCert, s.leafCert.chain))
+	if err != nil {
+		log.Fatal("Error creating certificate cache:", err)
+	}
+	if s.certStoreDir != "" {
+		s.certStore, err = newCertStore(s.certStoreDir)
+		if err != nil {
+			log.Fatal("Error loading certificate store:", err)
+		}
+		go s.certStore.watch(certStorePollInterval)
+	}
+	if s.pcapDir != "" {
+		s.pcap, err = newPcapWriter(s.pcapDir)
+		if err != nil {
+			log.Fatal("Error creating pcap directory:", err)
+		}
+	}
+	s.transport = s.newTransport()
+
+	return s
+}
+
+// Close stops the background work of the server. Connections being handled
+// are not affected.
+func (p Server) Close() {
+	p.certStore.close()
+}
+
+// certChain returns the certificates sent after forged leaves: the chain
+// file, preceded by the CA when it is an intermediate not already in it.
+func certChain(ca *x509.Certificate, chain [][]byte) [][]byte {
+	if ca.CheckSignatureFrom(ca) == nil {
+		return chain
+	}
+	if len(chain) > 0 && bytes.Equal(chain[0], ca.Raw) {
+		return chain
 	}
+
+	return append([][]byte{ca.Raw}, chain...)
 }
 
 func (p Server) HandleTLS(conn net.Conn) {
-	br := bufio.NewReader(conn)
+	br := bufio.NewReaderSize(conn, recordHeaderLen+maxPlaintextLen)
 
 	bc := buf.NewBufferedConn(conn, br)
 	defer bc.Close()
@@ -54,130 +187,266 @@ func (p Server) HandleTLS(conn net.Conn) {
 		return
 	}
 
-	var (
-		host string
-		r    *http.Request
-	)
 	if peek[0] == 'C' && string(peek) == "CONNECT" {
-		r, err = http.ReadRequest(br)
+		r, err := http.ReadRequest(br)
 		if err != nil {
 			slog.Error(fmt.Sprintf("Failed to read HTTP/1.1 5: %v", err))
 			return
 		}
-		host = r.Host
 		if _, err = bc.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
 			slog.Error(fmt.Sprintf("Failed to write HTTP/1.1 200 OK: %v", err))
 			return
 		}
 
-		peek, err = br.Peek(7)
-		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to peek HTTP/1.1 5: %v", err))
-			return
-		}
+		p.serveStream(bc, br, r, r.Host, "")
+		return
 	}
 
-	if peek[0] == 0x16 {
-		p.handleHTTPS(bc, host)
-	} else {
-		p.handleHTTP(bc)
-	}
+	p.serveStream(bc, br, nil, "", "")
 }
 
-func (p Server) handleHTTP(clientConn net.Conn) {
-	p.handle(clientConn, false)
-}
+// HandleTransparent serves a connection redirected to the proxy by iptables.
+// The upstream address is the original destination of the connection and the
+// certificate is chosen by the SNI of the TLS ClientHello. With tproxy the
+// original destination is the local address of the connection, otherwise it
+// is read from SO_ORIGINAL_DST.
+func (p Server) HandleTransparent(conn net.Conn, tproxy bool) {
+	br := bufio.NewReaderSize(conn, recordHeaderLen+maxPlaintextLen)
 
-func (p Server) handleHTTPS(clientConn net.Conn, host string) {
-	tlsCert := getTlsCert(host, p.caCert, p.caKey)
-	tlsConfig := &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
-		MinVersion:       tls.VersionTLS13,
-		Certificates:     []tls.Certificate{*tlsCert},
-	}
+	bc := buf.NewBufferedConn(conn, br)
+	defer bc.Close()
 
-	clientConn = tls.Server(clientConn, tlsConfig)
+	dst := conn.LocalAddr().String()
+	if !tproxy {
+		var err error
+		dst, err = originalDst(conn)
+		if err != nil {
+			slog.Error("Failed to get original destination", slog.String("err", err.Error()))
+			return
+		}
+		if dst == conn.LocalAddr().String() {
+			slog.Error("Connection was not redirected, refusing to connect to itself", slog.String("dst", dst))
+			return
+		}
+	}
 
-	p.handle(clientConn, true)
+	host, _, _ := net.SplitHostPort(dst)
+	p.serveStream(bc, br, nil, host, dst)
 }
 
-func (p Server) handle(clientConn net.Conn, isSsl bool) {
-	clientWriter := bufio.NewWriter(clientConn)
-	clientReader := bufio.NewReader(clientConn)
-
-	r, err := http.ReadRequest(clientReader)
-	if err == io.EOF {
+// serveStream sniffs the first bytes of a tunneled stream and serves it as
+// TLS or plain HTTP. For TLS the SNI of the ClientHello, when present, takes
+// precedence over host for picking the certificate. connectReq is the CONNECT
+// request that opened the tunnel, if any.
+func (p Server) serveStream(bc net.Conn, br *bufio.Reader, connectReq *http.Request, host, dst string) {
+	peek, err := br.Peek(1)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to peek stream: %v", err))
 		return
 	}
-	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to read request: %v", err))
+
+	if peek[0] != recordTypeHandshake {
+		p.handleHTTP(bc, dst)
 		return
 	}
 
-	originalRequest := r.Clone(r.Context())
+	hello, err := peekClientHello(br)
+	if err != nil {
+		slog.Debug("Failed to parse ClientHello", slog.String("host", host), slog.String("err", err.Error()))
+	} else if hello.serverName != "" {
+		host = hello.serverName
+	}
 
-	err = applyRules(p.requestRules, r, nil)
+	name, _, err := net.SplitHostPort(host)
 	if err != nil {
-		slog.Error("apply rules error", slog.String("err", err.Error()), slog.Any("request", r))
+		name = host
+	}
+
+	addr := dst
+	if addr == "" && connectReq != nil {
+		addr = getHost(connectReq.Host, "443")
+	}
+	if addr == "" {
+		addr = getHost(host, "443")
+	}
+
+	if reason, ok := p.passthrough.match(connectReq, name); ok && !p.isMagicHost(name) {
+		slog.Info("Passing TLS through without interception", slog.String("host", name), slog.String("addr", addr), slog.String("reason", reason))
+		p.tunnel(bc, addr)
 		return
 	}
 
-	originalRequest.Body = r.Body
+	p.handleHTTPS(bc, name, addr, dst, hello)
+}
 
-	logger := slog.With(slog.String("id", uuid.NewString()), slog.String("url", r.URL.String()), slog.String("method", r.Method))
-	logger.Debug("Received request")
+func (p Server) handleHTTP(clientConn net.Conn, dst string) {
+	p.handle(clientConn, false, dst, nil)
+}
 
-	var extConn net.Conn
-	if isSsl {
-		extConn, err = tls.Dial("tcp", getHost(r.Host, "443"), nil)
-	} else {
-		extConn, err = net.Dial("tcp", getHost(r.Host, "80"))
+// handleHTTPS terminates TLS for host with a certificate from the store or a
+// forged one. addr is the origin the client tunneled to, used when mirroring
+// its certificate. hello is the ClientHello of the client, if it was parsed.
+func (p Server) handleHTTPS(clientConn net.Conn, host, addr, dst string, hello *clientHello) {
+	tlsCert := p.certStore.get(host)
+	if tlsCert == nil && p.mirrorCerts && !p.isMagicHost(host) {
+		// A certificate mirrored for an earlier connection saves dialing
+		// the origin.
+		tlsCert = p.getMirroredTlsCertByHint(host)
+		if tlsCert == nil {
+			leaf, err := p.upstreamLeaf(host, addr)
+			if err != nil {
+				slog.Debug("Failed to get upstream certificate, forging a plain one", slog.String("addr", addr), slog.String("err", err.Error()))
+			} else {
+				tlsCert = p.getMirroredTlsCert(host, leaf)
+			}
+		}
+	}
+	if tlsCert == nil {
+		tlsCert = p.getTlsCert(host)
+	}
+	if tlsCert == nil {
+		slog.Error("No certificate to intercept TLS, closing the connection", slog.String("host", host))
+		clientConn.Close()
+		return
 	}
 
-	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to dial remote host: %v", err))
+	tlsConfig := p.clientTLSConfig(host)
+	tlsConfig.Certificates = []tls.Certificate{*tlsCert}
+
+	tlsConn := tls.Server(clientConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		slog.Error("TLS handshake with client failed", slog.String("host", host), slog.String("err", err.Error()))
+		p.passthrough.handshakeFailed(host, err)
 		return
 	}
-	defer extConn.Close()
+	p.passthrough.handshakeSucceeded(host)
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		p.handleH2(tlsConn, dst, hello)
+		return
+	}
+
+	p.handle(tlsConn, true, dst, hello)
+}
 
-	logger.Debug("Connected to remote host", slog.String("host", r.Host), slog.Bool("isSsl", isSsl))
+// handle proxies HTTP/1.1 requests read from clientConn. When dst is not empty
+// the upstream connection goes to dst instead of the request host.
+func (p Server) handle(clientConn net.Conn, isSsl bool, dst string, hello *clientHello) {
+	clientWriter := bufio.NewWriter(clientConn)
+	clientReader := bufio.NewReader(clientConn)
 
-	extReader := bufio.NewReader(extConn)
-	extWriter := bufio.NewWriter(extConn)
+	flow := p.pcap.newFlow(clientConn)
+	defer flow.close()
 
-	var resp *http.Response
 	for {
-		err = r.Write(extWriter)
+		r, err := http.ReadRequest(clientReader)
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to write request: %v", err))
+			slog.Error(fmt.Sprintf("Failed to read request: %v", err))
 			return
 		}
 
-		logger.Debug("Sent request", slog.Any("request", r))
+		if r.URL.Host == "" {
+			r.URL.Host = r.Host
+			r.URL.Scheme = "http"
+			if isSsl {
+				r.URL.Scheme = "https"
+			}
+		}
 
-		err = extWriter.Flush()
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to flush request: %v", err))
-			return
+		if p.isMagicHost(r.URL.Host) {
+			io.Copy(io.Discard, r.Body)
+			resp := p.magicResponse(r, clientConn.LocalAddr())
+			err = resp.Write(clientWriter)
+			if err == nil {
+				err = clientWriter.Flush()
+			}
+			if err != nil {
+				slog.Error(fmt.Sprintf("Failed to write response: %v", err))
+				return
+			}
+			if !isKeepAlive(r) {
+				return
+			}
+			continue
 		}
 
-		logger.Debug("Flushed request")
+		originalRequest := r.Clone(r.Context())
 
-		resp, err = http.ReadResponse(extReader, r)
+		var resp *http.Response
+		err = applyRules(p.requestRules, r, nil)
+		var respond *rule.RespondError
+		if errors.As(err, &respond) {
+			resp = ruleResponse(r, respond.Response)
+			err = nil
+		}
+		if errors.Is(err, rule.ErrReset) {
+			slog.Info("Resetting connection", slog.String("url", r.URL.String()), slog.String("err", err.Error()))
+			resetConn(clientConn)
+			return
+		}
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to read response: %v", err))
+			slog.Error("apply rules error", slog.String("err", err.Error()), slog.Any("request", r))
 			return
 		}
 
-		logger.Debug("Received response", slog.Any("response", resp))
+		originalRequest.Body = r.Body
+
+		logger := slog.With(slog.String("id", uuid.NewString()), slog.String("url", r.URL.String()), slog.String("method", r.Method))
+		logger.Debug("Received request")
+
+		keepAlive := isKeepAlive(r)
+		webSocket := isWebSocket(r)
+
+		exchange := flow.begin(r)
+
+		if resp != nil {
+			logger.Debug("Responding from rule", slog.Int("status", resp.StatusCode))
+			io.Copy(io.Discard, r.Body)
+		} else {
+			resp, err = p.transport.RoundTrip(upstreamRequest(r, requestDst(originalRequest, r, dst), hello))
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to send request: %v", err))
+				exchange.end()
+				writeBadGateway(clientWriter)
+				return
+			}
+
+			logger.Debug("Received response", slog.Any("response", resp))
+
+			if webSocket && resp.StatusCode == http.StatusSwitchingProtocols {
+				exchange.response(resp)
+				exchange.end()
+				p.upgrade(logger, clientConn, clientReader, clientWriter, resp)
+				return
+			}
+		}
 
 		err = applyRules(p.responseRules, originalRequest, resp)
+		if errors.As(err, &respond) {
+			resp.Body.Close()
+			resp = ruleResponse(originalRequest, respond.Response)
+			err = nil
+		}
 		if err != nil {
+			resp.Body.Close()
+			exchange.end()
+			if errors.Is(err, rule.ErrReset) {
+				logger.Info("Resetting connection", slog.String("err", err.Error()))
+				resetConn(clientConn)
+				return
+			}
 			logger.Error("apply rules error", slog.String("err", err.Error()))
 			return
 		}
 
+		toHTTP1(resp)
+		exchange.response(resp)
 		err = resp.Write(clientWriter)
+		resp.Body.Close()
+		exchange.end()
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed to write response: %v", err))
 			return
@@ -193,49 +462,40 @@ func (p Server) handle(clientConn net.Conn, isSsl bool) {
 
 		logger.Debug("Flushed response")
 
-		if isWebSocket(r) {
-			logger.Debug("Upgrading to WebSocket")
-
-			errChan := make(chan error, 2)
-			copyConn := func(a, b net.Conn) {
-				buffer := buf.ByteGet(BufSize)
-				defer buf.BytePut(buffer)
-				_, err := io.CopyBuffer(a, b, buffer)
-				errChan <- err
-			}
-
-			go copyConn(clientConn, extConn)
-			go copyConn(extConn, clientConn)
-			select {
-			case err = <-errChan:
-				if err != nil {
-					logger.Error(fmt.Sprintf("Failed to write response: %v", err))
-				}
-			}
-			return
-		}
-
-		if !isKeepAlive(r) {
+		if !keepAlive || resp.Close {
 			logger.Debug("Closing connection")
 			return
 		}
+	}
+}
 
-		r, err = http.ReadRequest(clientReader)
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to read request: %v", err))
-			return
-		}
+// upgrade completes a WebSocket handshake with the client and then copies
+// frames in both directions until either side closes.
+func (p Server) upgrade(logger *slog.Logger, clientConn net.Conn, clientReader *bufio.Reader, clientWriter *bufio.Writer, resp *http.Response) {
+	logger.Debug("Upgrading to WebSocket")
 
-		err = applyRules(p.requestRules, r, nil)
-		if err != nil {
-			logger.Error("apply rules error", slog.String("err", err.Error()), slog.Any("request", r))
-			return
-		}
+	extConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		logger.Error("Upgraded response body is not writable")
+		return
+	}
+	defer extConn.Close()
+
+	resp.Body = nil
+	err := resp.Write(clientWriter)
+	if err == nil {
+		err = clientWriter.Flush()
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to write response: %v", err))
+		return
+	}
 
-		logger.Debug("Received request", slog.Any("request", r))
+	if err = pipe(struct {
+		io.Reader
+		io.Writer
+	}{clientReader, clientConn}, extConn); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write response: %v", err))
 	}
 }
 
@@ -252,7 +512,7 @@ func applyRules(rules []*rule.Rule, req *http.Request, resp *http.Response) erro
 
 		err = r.Apply(req, resp)
 		if err != nil {
-			return fmt.Errorf(`apply rule "%s" error: %v`, r.Name, err)
+			return fmt.Errorf(`apply rule "%s" error: %w`, r.Name, err)
 		}
 
 	}
@@ -260,6 +520,45 @@ func applyRules(rules []*rule.Rule, req *http.Request, resp *http.Response) erro
 	return nil
 }
 
+// resetConn closes conn with a TCP RST instead of a FIN when it is a TCP
+// connection, looking through TLS and buffering wrappers.
+func resetConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetLinger(0)
+			c.Close()
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// ruleResponse completes a response produced by a request rule to be sent
+// for r.
+func ruleResponse(r *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.Status == "" {
+		resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	resp.Request = r
+
+	return resp
+}
+
 func isWebSocket(r *http.Request) bool {
 	return r.Header.Get("Upgrade") == "websocket"
 }
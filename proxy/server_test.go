@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/rule"
+)
+
+// newEchoOrigin starts an origin answering with the request line and the
+// headers the proxy sent, and counts the requests it got.
+func newEchoOrigin(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Origin", "yes")
+		fmt.Fprintf(w, "%s %s host=%s rule=%s proxy-connection=%s body=%s",
+			r.Method, r.URL.Path, r.Host, r.Header.Get("X-Rule"), r.Header.Get("Proxy-Connection"), body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &hits
+}
+
+// newRulesServer returns a proxy with the rules of a rule file.
+func newRulesServer(t *testing.T, rules string) Server {
+	t.Helper()
+
+	p := Server{dialer: &net.Dialer{}}
+	if rules != "" {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if p.requestRules, p.responseRules, err = rule.CompileRules(dir, nil); err != nil {
+			t.Fatalf("CompileRules: %v", err)
+		}
+	}
+	p.transport = p.newTransport()
+
+	return p
+}
+
+// serveHTTP1 runs handle on one end of a pipe and returns the other end.
+func serveHTTP1(t *testing.T, p Server, dst string) (net.Conn, *bufio.Reader) {
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		p.handle(conn, false, dst, nil)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	return client, bufio.NewReader(client)
+}
+
+func roundTripHTTP1(t *testing.T, client net.Conn, br *bufio.Reader, request string) (*http.Response, string) {
+	t.Helper()
+
+	if _, err := io.WriteString(client, request); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	return resp, string(body)
+}
+
+func TestHandleKeepAlive(t *testing.T) {
+	origin, hits := newEchoOrigin(t)
+	host := origin.Listener.Addr().String()
+	p := newRulesServer(t, `enabled: true
+rules:
+  - name: tag
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/a'"
+    action: set_header
+    headers:
+      X-Rule: tagged
+  - name: mark
+    enabled: true
+    change: response
+    rule: "true"
+    action: set_header
+    headers:
+      X-Proxied: "yes"
+`)
+	client, br := serveHTTP1(t, p, "")
+
+	resp, body := roundTripHTTP1(t, client, br, "GET http://"+host+"/a HTTP/1.1\r\nHost: "+host+"\r\nProxy-Connection: keep-alive\r\n\r\n")
+	if want := "GET /a host=" + host + " rule=tagged proxy-connection= body="; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	if resp.Header.Get("X-Origin") != "yes" || resp.Header.Get("X-Proxied") != "yes" {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+
+	_, body = roundTripHTTP1(t, client, br, "POST http://"+host+"/b HTTP/1.1\r\nHost: "+host+"\r\nProxy-Connection: keep-alive\r\nContent-Length: 5\r\n\r\nhello")
+	if want := "POST /b host=" + host + " rule= proxy-connection= body=hello"; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	// Without keep-alive the proxy closes the connection after the response.
+	roundTripHTTP1(t, client, br, "GET http://"+host+"/c HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	if hits.Load() != 3 {
+		t.Errorf("origin got %d requests, want 3", hits.Load())
+	}
+}
+
+func TestHandleRuleResponse(t *testing.T) {
+	origin, hits := newEchoOrigin(t)
+	host := origin.Listener.Addr().String()
+	p := newRulesServer(t, `enabled: true
+rules:
+  - name: stub
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/stub'"
+    action: respond
+    status: 201
+    body: stubbed
+  - name: mark
+    enabled: true
+    change: response
+    rule: "true"
+    action: set_header
+    headers:
+      X-Proxied: "yes"
+`)
+	client, br := serveHTTP1(t, p, "")
+
+	resp, body := roundTripHTTP1(t, client, br, "POST http://"+host+"/stub HTTP/1.1\r\nHost: "+host+"\r\nProxy-Connection: keep-alive\r\nContent-Length: 3\r\n\r\nabc")
+	if resp.StatusCode != http.StatusCreated || body != "stubbed" || resp.Header.Get("X-Proxied") != "yes" {
+		t.Errorf("got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("origin got %d requests for a stubbed response", hits.Load())
+	}
+
+	// The request body was drained, so the connection is still usable.
+	_, body = roundTripHTTP1(t, client, br, "GET http://"+host+"/next HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if body != "GET /next host="+host+" rule= proxy-connection= body=" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestHandleDst(t *testing.T) {
+	origin, _ := newEchoOrigin(t)
+	p := newRulesServer(t, "")
+
+	// Transparent and SOCKS5 connections dial the original destination,
+	// whatever the request host.
+	client, br := serveHTTP1(t, p, origin.Listener.Addr().String())
+	_, body := roundTripHTTP1(t, client, br, "GET /x HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if body != "GET /x host=origin.test rule= proxy-connection= body=" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	origin, hits := newEchoOrigin(t)
+	host := origin.Listener.Addr().String()
+	p := newRulesServer(t, `enabled: true
+rules:
+  - name: reset
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/reset'"
+    action: reject
+    reset: true
+`)
+
+	client, br := serveHTTP1(t, p, "")
+	io.WriteString(client, "GET http://"+host+"/reset HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("expected the connection to be reset")
+	}
+	if hits.Load() != 0 {
+		t.Errorf("origin got %d requests", hits.Load())
+	}
+
+	// An unreachable origin gets a 502.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	client, br = serveHTTP1(t, p, "")
+	resp, _ := roundTripHTTP1(t, client, br, "GET http://"+closed+"/ HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestHandlePcapOnReset(t *testing.T) {
+	origin, _ := newEchoOrigin(t)
+	host := origin.Listener.Addr().String()
+	p := newRulesServer(t, `enabled: true
+rules:
+  - name: reset
+    enabled: true
+    change: response
+    rule: "true"
+    action: reject
+    reset: true
+`)
+	dir := t.TempDir()
+	var err error
+	if p.pcap, err = newPcapWriter(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	client, br := serveHTTP1(t, p, "")
+	io.WriteString(client, "GET http://"+host+"/reset HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if _, err = br.ReadByte(); err == nil {
+		t.Error("expected the connection to be reset")
+	}
+	client.Close()
+
+	// The exchange is recorded once the connection is closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+		if len(files) == 1 {
+			if _, payload := readPcap(t, files[0]); !strings.Contains(payload, "GET /reset HTTP/1.1\r\n") {
+				t.Errorf("request missing from %q", payload)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one capture file, got %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/buf"
+)
+
+const (
+	socksVersion5        = 0x05
+	socksAuthVersion     = 0x01
+	socksAuthNone        = 0x00
+	socksAuthPassword    = 0x02
+	socksAuthUnavailable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded           = 0x00
+	socksRepNotAllowed          = 0x02
+	socksRepCommandNotSupported = 0x07
+	socksRepAtypNotSupported    = 0x08
+)
+
+var errSocksAuthFailed = errors.New("socks5 authentication failed")
+
+// HandleSOCKS5 serves a SOCKS5 (RFC 1928) client. Only the CONNECT command is
+// supported; the tunneled stream is intercepted the same way as an HTTP
+// CONNECT tunnel.
+func (p Server) HandleSOCKS5(conn net.Conn) {
+	br := bufio.NewReaderSize(conn, recordHeaderLen+maxPlaintextLen)
+
+	bc := buf.NewBufferedConn(conn, br)
+	defer bc.Close()
+
+	dst, err := socks5Handshake(bc, p.socksUser, p.socksPassword)
+	if err != nil {
+		slog.Error("SOCKS5 handshake failed", slog.String("remote", conn.RemoteAddr().String()), slog.String("err", err.Error()))
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(dst)
+	p.serveStream(bc, br, nil, host, dst)
+}
+
+// socks5Handshake negotiates authentication and reads the CONNECT request,
+// returning the requested destination address.
+func socks5Handshake(rw io.ReadWriter, user, password string) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNone)
+	if user != "" {
+		method = socksAuthPassword
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		rw.Write([]byte{socksVersion5, socksAuthUnavailable})
+		return "", fmt.Errorf("client offered no acceptable auth method")
+	}
+
+	if _, err := rw.Write([]byte{socksVersion5, method}); err != nil {
+		return "", err
+	}
+
+	if method == socksAuthPassword {
+		if err := socks5Authenticate(rw, user, password); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(rw, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported socks version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(rw, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(rw, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(rw, socksRepAtypNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rw, port); err != nil {
+		return "", err
+	}
+
+	if request[1] != socksCmdConnect {
+		socks5Reply(rw, socksRepCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	if err := socks5Reply(rw, socksRepSucceeded); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Authenticate runs the username/password sub-negotiation (RFC 1929).
+func socks5Authenticate(rw io.ReadWriter, user, password string) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return err
+	}
+	if header[0] != socksAuthVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+
+	gotUser := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, gotUser); err != nil {
+		return err
+	}
+
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(rw, length); err != nil {
+		return err
+	}
+	gotPassword := make([]byte, length[0])
+	if _, err := io.ReadFull(rw, gotPassword); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(gotUser, []byte(user)) != 1 ||
+		subtle.ConstantTimeCompare(gotPassword, []byte(password)) != 1 {
+		rw.Write([]byte{socksAuthVersion, socksRepNotAllowed})
+		return errSocksAuthFailed
+	}
+
+	_, err := rw.Write([]byte{socksAuthVersion, socksRepSucceeded})
+	return err
+}
+
+func socks5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socksVersion5, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
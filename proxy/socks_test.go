@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	cases := []struct {
+		name     string
+		auth     *xproxy.Auth
+		wantErr  bool
+		wantAddr string
+	}{
+		{name: "valid credentials", auth: &xproxy.Auth{User: "user", Password: "secret"}, wantAddr: "example.com:443"},
+		{name: "wrong password", auth: &xproxy.Auth{User: "user", Password: "wrong"}, wantErr: true},
+		{name: "no credentials", auth: nil, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			clientErr := make(chan error, 1)
+			go func() {
+				defer client.Close()
+				dialer, err := xproxy.SOCKS5("tcp", "proxy:1080", tc.auth, pipeDialer{conn: client})
+				if err != nil {
+					clientErr <- err
+					return
+				}
+				_, err = dialer.Dial("tcp", "example.com:443")
+				clientErr <- err
+			}()
+
+			addr, err := socks5Handshake(server, "user", "secret")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected handshake error, got addr %q", addr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("socks5Handshake: %v", err)
+			}
+			if addr != tc.wantAddr {
+				t.Fatalf("expected addr %q, got %q", tc.wantAddr, addr)
+			}
+			if err = <-clientErr; err != nil {
+				t.Fatalf("client dial: %v", err)
+			}
+		})
+	}
+}
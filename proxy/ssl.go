@@ -2,12 +2,11 @@ package proxy
 
 import (
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -15,16 +14,17 @@ import (
 	"math/big"
 	"net"
 	"os"
-	"sync"
-	"time"
+	"strings"
 )
 
-var certMap = &sync.Map{}
-
-func createCert(dnsName string, parent *x509.Certificate, parentKey crypto.PrivateKey, hoursValid int) (cert []byte, priv []byte, err error) {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, nil, errors.New(fmt.Sprintf("Failed to generate private key: %v", err))
+// createCert signs a leaf certificate built from template for leafKey, or
+// for a new key when leafKey is nil.
+func createCert(template *x509.Certificate, parent *x509.Certificate, parentKey crypto.PrivateKey, leafKey crypto.Signer) (cert []byte, priv []byte, err error) {
+	if leafKey == nil {
+		leafKey, err = generateKey("ecdsa")
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
@@ -33,21 +33,10 @@ func createCert(dnsName string, parent *x509.Certificate, parentKey crypto.Priva
 		return nil, nil, errors.New(fmt.Sprintf("Failed to generate serial number: %v", err))
 	}
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"MITM proxy"},
-		},
-		DNSNames:  []string{dnsName},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(time.Duration(hoursValid) * time.Hour),
-
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-	}
+	template.SerialNumber = serialNumber
+	template.BasicConstraintsValid = true
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, &privateKey.PublicKey, parentKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, leafKey.Public(), parentKey)
 	if err != nil {
 		return nil, nil, errors.New(fmt.Sprintf("Failed to create certificate: %v", err))
 	}
@@ -56,7 +45,7 @@ func createCert(dnsName string, parent *x509.Certificate, parentKey crypto.Priva
 		return nil, nil, errors.New(fmt.Sprintf("failed to encode certificate to PEM"))
 	}
 
-	privBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	privBytes, err := x509.MarshalPKCS8PrivateKey(leafKey)
 	if err != nil {
 		return nil, nil, errors.New(fmt.Sprintf("Unable to marshal private key: %v", err))
 	}
@@ -68,56 +57,160 @@ func createCert(dnsName string, parent *x509.Certificate, parentKey crypto.Priva
 	return pemCert, pemKey, nil
 }
 
+// loadX509KeyPair reads the CA certificate and key. The key may be PKCS#8,
+// PKCS#1 or SEC1 encoded, and may follow the certificate in certFile when
+// keyFile is empty or the same file.
 func loadX509KeyPair(certFile, keyFile string) (cert *x509.Certificate, key any, err error) {
 	cf, err := os.ReadFile(certFile)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	kf, err := os.ReadFile(keyFile)
-	if err != nil {
-		return nil, nil, err
+	if keyFile == "" {
+		keyFile = certFile
 	}
-	certBlock, _ := pem.Decode(cf)
-	cert, err = x509.ParseCertificate(certBlock.Bytes)
-	if err != nil {
-		return nil, nil, err
+
+	kf := cf
+	if keyFile != certFile {
+		kf, err = os.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	keyBlock, _ := pem.Decode(kf)
-	key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
-	if err != nil {
-		return nil, nil, err
+	for rest := cf; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, nil, fmt.Errorf("no certificate found in %s", certFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+
+	for rest := kf; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, nil, fmt.Errorf("no private key found in %s", keyFile)
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key, err = parsePrivateKey(block)
+			if err != nil {
+				return nil, nil, err
+			}
+			break
+		}
 	}
 
 	return cert, key, nil
 }
 
-func getTlsCert(host string, parent *x509.Certificate, parentKey crypto.PrivateKey) *tls.Certificate {
+func parsePrivateKey(block *pem.Block) (any, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+}
+
+func (p Server) getTlsCert(host string) *tls.Certificate {
 	h, _, err := net.SplitHostPort(host)
 	if err != nil {
-		slog.Error("error splitting h/port", slog.String("h", h), slog.Any("err", err))
 		h = host
 	}
 
-	v, ok := certMap.Load(h)
-	var tlsCert tls.Certificate
-	if ok {
-		tlsCert = v.(tls.Certificate)
-	} else {
-		pemCert, pemKey, err := createCert(h, parent, parentKey, 240)
+	names := p.leafCert.certNames(h)
+
+	return p.loadOrCreateCert(names[0], func() (*x509.Certificate, error) {
+		return p.leafCert.template(names, p.caCert)
+	})
+}
+
+// getMirroredTlsCert returns a certificate for host mirroring upstream,
+// cached by the fingerprint of upstream so a renewed origin certificate is
+// mirrored again. The key is remembered for host for mirrorHintTTL, so
+// later connections to host don't dial the origin.
+func (p Server) getMirroredTlsCert(host string, upstream *x509.Certificate) *tls.Certificate {
+	fingerprint := sha256.Sum256(upstream.Raw)
+	key := "mirror:" + hex.EncodeToString(fingerprint[:])
+	if len(upstream.DNSNames) == 0 && len(upstream.IPAddresses) == 0 {
+		// The SANs come from host, not from upstream.
+		key += "@" + strings.ToLower(host)
+	}
+
+	tlsCert := p.loadOrCreateCert(key, func() (*x509.Certificate, error) {
+		return p.leafCert.mirrorTemplate(host, upstream, p.caCert)
+	})
+	if tlsCert != nil {
+		p.certs.setHint(mirrorHint(host), key, mirrorHintTTL)
+	}
+
+	return tlsCert
+}
+
+// getMirroredTlsCertByHint returns the certificate last mirrored for host,
+// if its hint didn't expire.
+func (p Server) getMirroredTlsCertByHint(host string) *tls.Certificate {
+	key, ok := p.certs.hint(mirrorHint(host))
+	if !ok {
+		return nil
+	}
+
+	return p.certs.get(key)
+}
+
+func mirrorHint(host string) string {
+	return "mirror:" + strings.ToLower(host)
+}
+
+// loadOrCreateCert returns the cached certificate for key or mints one from
+// the template returned by newTemplate. Concurrent calls for the same key
+// share a single certificate.
+func (p Server) loadOrCreateCert(key string, newTemplate func() (*x509.Certificate, error)) *tls.Certificate {
+	if tlsCert := p.certs.get(key); tlsCert != nil {
+		return tlsCert
+	}
+
+	v, err, _ := p.certFlight.Do(key, func() (any, error) {
+		// Another call may have finished minting while this one waited.
+		if tlsCert := p.certs.get(key); tlsCert != nil {
+			return tlsCert, nil
+		}
+
+		template, err := newTemplate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build certificate template: %v", err)
+		}
+
+		pemCert, pemKey, err := createCert(template, p.caCert, p.caKey, p.leafKey)
 		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to create cert/key pair: %v", err))
-			return nil
+			return nil, fmt.Errorf("failed to create cert/key pair: %v", err)
 		}
-		tlsCert, err = tls.X509KeyPair(pemCert, pemKey)
+		tlsCert, err := tls.X509KeyPair(pemCert, pemKey)
 		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to create certificate: %v", err))
-			return nil
+			return nil, fmt.Errorf("failed to create certificate: %v", err)
 		}
+		tlsCert.Certificate = append(tlsCert.Certificate, p.certs.chain...)
+
+		p.certs.add(key, &tlsCert)
 
-		certMap.Store(h, tlsCert)
+		return &tlsCert, nil
+	})
+	if err != nil {
+		slog.Error(err.Error(), slog.String("key", key))
+		return nil
 	}
 
-	return &tlsCert
+	return v.(*tls.Certificate)
 }
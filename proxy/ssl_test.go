@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func newTestCA(t *testing.T) (*x509.Certificate, crypto.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA: %v", err)
+	}
+
+	return cert, key
+}
+
+func newTestServer(t *testing.T, cacheDir string) Server {
+	t.Helper()
+
+	ca, caKey := newTestCA(t)
+	leafCert := defaultLeafCert()
+	certs, err := newCertCache(0, cacheDir, leafCert.hash, ca, nil)
+	if err != nil {
+		t.Fatalf("newCertCache: %v", err)
+	}
+
+	leafKey, err := generateKey("ecdsa")
+	if err != nil {
+		t.Fatalf("generateKey: %v", err)
+	}
+
+	return Server{caCert: ca, caKey: caKey, certs: certs, certFlight: &singleflight.Group{}, leafKey: leafKey, leafCert: leafCert}
+}
+
+func TestGetMirroredTlsCert(t *testing.T) {
+	p := newTestServer(t, "")
+
+	notBefore := time.Now().Add(-24 * time.Hour).Truncate(time.Second).UTC()
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second).UTC()
+	upstream := &x509.Certificate{
+		Raw:         []byte("upstream"),
+		Subject:     pkix.Name{CommonName: "origin.example.com"},
+		DNSNames:    []string{"origin.example.com", "*.cdn.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.10")},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+	}
+
+	tlsCert := p.getMirroredTlsCert("origin.example.com", upstream)
+	if tlsCert == nil {
+		t.Fatal("expected a certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse leaf: %v", err)
+	}
+
+	if leaf.Subject.CommonName != "origin.example.com" {
+		t.Errorf("unexpected common name %q", leaf.Subject.CommonName)
+	}
+	if len(leaf.DNSNames) != 2 || leaf.DNSNames[1] != "*.cdn.example.com" {
+		t.Errorf("unexpected DNS names %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("unexpected IP addresses %v", leaf.IPAddresses)
+	}
+	if leaf.NotBefore.Before(notBefore.Add(23*time.Hour)) || !leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("unexpected validity %v - %v", leaf.NotBefore, leaf.NotAfter)
+	}
+	if err = leaf.CheckSignatureFrom(p.caCert); err != nil {
+		t.Errorf("leaf not signed by CA: %v", err)
+	}
+
+	if p.getMirroredTlsCertByHint("Origin.Example.com") != tlsCert || p.getMirroredTlsCert("origin.example.com", upstream) != tlsCert {
+		t.Error("expected the mirrored certificate to be cached")
+	}
+
+	// A renewed origin certificate is mirrored again, and the host is
+	// pointed at the new one.
+	renewed := *upstream
+	renewed.Raw = []byte("renewed")
+	renewedCert := p.getMirroredTlsCert("origin.example.com", &renewed)
+	if renewedCert == tlsCert || p.getMirroredTlsCertByHint("origin.example.com") != renewedCert {
+		t.Error("expected a renewed origin certificate to be mirrored again")
+	}
+
+	// An origin certificate expiring soon, or expired, leaves the mirrored
+	// one with the leaf validity, so it is not minted again right away.
+	for name, expires := range map[string]time.Time{"expiring": time.Now().Add(time.Minute), "expired": time.Now().Add(-time.Minute)} {
+		old := *upstream
+		old.Raw = []byte(name)
+		old.NotAfter = expires
+		oldCert := p.getMirroredTlsCert("origin.example.com", &old)
+		if !fresh(oldCert.Leaf) || oldCert.Leaf.NotAfter.Before(time.Now().Add(defaultLeafValidity-time.Hour)) {
+			t.Errorf("%s: unexpected validity %v - %v", name, oldCert.Leaf.NotBefore, oldCert.Leaf.NotAfter)
+		}
+		if p.getMirroredTlsCert("origin.example.com", &old) != oldCert {
+			t.Errorf("%s: expected the mirrored certificate to be cached", name)
+		}
+	}
+
+	// An origin naming itself only in the common name gets the host as SAN.
+	cnOnly := &x509.Certificate{
+		Raw:       []byte("cn-only"),
+		Subject:   pkix.Name{CommonName: "legacy.example.com"},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}
+	for host, check := range map[string]func(*x509.Certificate) bool{
+		"legacy.example.com": func(leaf *x509.Certificate) bool {
+			return len(leaf.DNSNames) == 1 && leaf.DNSNames[0] == "legacy.example.com" && len(leaf.IPAddresses) == 0
+		},
+		"192.0.2.20": func(leaf *x509.Certificate) bool {
+			return len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 1 && leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.20"))
+		},
+	} {
+		leaf, err := x509.ParseCertificate(p.getMirroredTlsCert(host, cnOnly).Certificate[0])
+		if err != nil {
+			t.Fatalf("parse leaf: %v", err)
+		}
+		if !check(leaf) || leaf.VerifyHostname(host) != nil {
+			t.Errorf("%s: unexpected SANs %v %v", host, leaf.DNSNames, leaf.IPAddresses)
+		}
+	}
+}
+
+func TestHandleHTTPSMirrorCached(t *testing.T) {
+	p := newTestServer(t, "")
+	p.mirrorCerts = true
+	p.clientTLS = defaultClientTLS()
+	p.dialer = &net.Dialer{}
+
+	// The origin is unreachable, so a handshake with the cached mirrored
+	// certificate shows the cache was checked before dialing.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	upstream := &x509.Certificate{
+		Raw:       []byte("upstream"),
+		Subject:   pkix.Name{CommonName: "Mirrored Origin"},
+		DNSNames:  []string{"cached.example.com", "alt.example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	cached := p.getMirroredTlsCert("cached.example.com", upstream)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		p.handleHTTPS(server, "cached.example.com", addr, "", nil)
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.caCert)
+	tlsConn := tls.Client(client, &tls.Config{ServerName: "cached.example.com", RootCAs: pool})
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if !bytes.Equal(tlsConn.ConnectionState().PeerCertificates[0].Raw, cached.Certificate[0]) {
+		t.Error("expected the cached mirrored certificate")
+	}
+}
+
+func TestGetTlsCertConcurrent(t *testing.T) {
+	p := newTestServer(t, "")
+
+	certs := make([]*tls.Certificate, 16)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs[i] = p.getTlsCert("parallel.example.com:443")
+		}()
+	}
+	wg.Wait()
+
+	for _, cert := range certs[1:] {
+		if cert != certs[0] {
+			t.Fatal("expected concurrent calls to share one certificate")
+		}
+	}
+
+	other := p.getTlsCert("other.example.com")
+	if !other.Leaf.PublicKey.(*ecdsa.PublicKey).Equal(certs[0].Leaf.PublicKey) {
+		t.Error("expected certificates to share the leaf key")
+	}
+}
+
+func TestHandleHTTPSWithoutCert(t *testing.T) {
+	p := newTestServer(t, "")
+	// A CA key that doesn't match the CA certificate fails every signature.
+	otherKey, err := generateKey("ecdsa")
+	if err != nil {
+		t.Fatalf("generateKey: %v", err)
+	}
+	p.caKey = otherKey
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handleHTTPS(server, "example.com", "example.com:443", "", nil)
+	}()
+
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	<-done
+}
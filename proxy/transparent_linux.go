@@ -0,0 +1,90 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	soOriginalDst = 80
+	ipTransparent = 19
+)
+
+// ListenTransparent opens a listener for traffic redirected by iptables.
+// With tproxy the socket is marked IP_TRANSPARENT so it can accept
+// connections addressed to foreign IPs.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination address of a connection redirected
+// with iptables REDIRECT, read from the SO_ORIGINAL_DST socket option.
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("original destination requires a TCP connection, got %T", conn)
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		dst     string
+		sockErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		if tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// sockaddr_in fits into ipv6_mreq: family, port, address.
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			ip := net.IP(mreq.Multiaddr[4:8])
+			dst = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			return
+		}
+
+		// sockaddr_in6 is the leading part of ip6_mtuinfo.
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		ip := net.IP(info.Addr.Addr[:])
+		dst = net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %v", sockErr)
+	}
+
+	return dst, nil
+}
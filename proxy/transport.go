@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	maxIdleConnsPerHost = 64
+	idleConnTimeout     = 90 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// dstKey carries the address to dial instead of the request host, set for
+// transparent and SOCKS5 connections.
+type dstKey struct{}
+
+// dialFunc dials an upstream connection.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// http1OnlyKey marks requests that can't be sent over HTTP/2, such as
+// WebSocket upgrades.
+type http1OnlyKey struct{}
+
+// newTransport returns the upstream transport shared by all client
+// connections. Requests of transparent and SOCKS5 connections, which go to
+// their original destination instead of the request host, are sent through a
+// transport per destination, so pooled connections are only reused for the
+// destination they were opened to.
+func (p Server) newTransport() http.RoundTripper {
+	return &dstTransport{
+		p:     p,
+		def:   p.newOriginTransport(""),
+		byDst: make(map[string]*dstEntry),
+	}
+}
+
+// newOriginTransport returns a transport that pools connections per host and
+// negotiates HTTP/2 with origin servers that support it. When dst is not
+// empty all connections go to dst, whatever the request host.
+func (p Server) newOriginTransport(dst string) http.RoundTripper {
+	dial := p.dialFunc(dst)
+	t := &http.Transport{
+		DialContext: dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTLS(ctx, dial, network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+	}
+	if p.usesFingerprints() {
+		return p.newFingerprintTransport(t, dial)
+	}
+
+	return t
+}
+
+// dialFunc returns a dialer connecting to dst, or to the address it is
+// given when dst is empty.
+func (p Server) dialFunc(dst string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dst != "" {
+			addr = dst
+		}
+
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// dialTLS connects with dial and does the TLS handshake for the host of
+// addr.
+func (p Server) dialTLS(ctx context.Context, dial dialFunc, network, addr string) (net.Conn, error) {
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nextProtos := []string{http2.NextProtoTLS, "http/1.1"}
+	if http1Only, _ := ctx.Value(http1OnlyKey{}).(bool); http1Only {
+		nextProtos = []string{"http/1.1"}
+	}
+
+	tlsConfig := p.upstreamTLSConfig(serverName)
+	tlsConfig.NextProtos = nextProtos
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// dstTransport sends requests carrying a dstKey through a transport dialing
+// that destination and everything else through def.
+type dstTransport struct {
+	p   Server
+	def http.RoundTripper
+
+	mu    sync.Mutex
+	byDst map[string]*dstEntry
+}
+
+type dstEntry struct {
+	rt   http.RoundTripper
+	used time.Time
+}
+
+func (t *dstTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dst, _ := req.Context().Value(dstKey{}).(string)
+	if dst == "" {
+		return t.def.RoundTrip(req)
+	}
+
+	return t.forDst(dst).RoundTrip(req)
+}
+
+// forDst returns the transport of dst, creating it the first time.
+func (t *dstTransport) forDst(dst string) http.RoundTripper {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.byDst[dst]
+	if !ok {
+		t.evict(now)
+		e = &dstEntry{rt: t.p.newOriginTransport(dst)}
+		t.byDst[dst] = e
+	}
+	e.used = now
+
+	return e.rt
+}
+
+// evict drops the transports of destinations that were not used for longer
+// than idle connections are kept.
+func (t *dstTransport) evict(now time.Time) {
+	for dst, e := range t.byDst {
+		if now.Sub(e.used) > idleConnTimeout {
+			closeIdleConnections(e.rt)
+			delete(t.byDst, dst)
+		}
+	}
+}
+
+func (t *dstTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	closeIdleConnections(t.def)
+	for _, e := range t.byDst {
+		closeIdleConnections(e.rt)
+	}
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// upstreamLeaf connects to the origin at addr and returns the leaf
+// certificate it presents for serverName.
+func (p Server) upstreamLeaf(serverName, addr string) (*x509.Certificate, error) {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	conn, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, p.upstreamTLSConfig(serverName))
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return tlsConn.ConnectionState().PeerCertificates[0], nil
+}
+
+// upstreamRequest prepares r to be sent through the shared transport. hello
+// is the ClientHello of the client, replayed to the origin when the host's
+// TLS fingerprint is "client".
+func upstreamRequest(r *http.Request, dst string, hello *clientHello) *http.Request {
+	ctx := r.Context()
+	if dst != "" {
+		ctx = context.WithValue(ctx, dstKey{}, dst)
+	}
+	if hello != nil {
+		ctx = context.WithValue(ctx, clientHelloKey{}, hello)
+	}
+
+	webSocket := isWebSocket(r)
+	if webSocket {
+		ctx = context.WithValue(ctx, http1OnlyKey{}, true)
+	}
+
+	out := r.WithContext(ctx)
+	out.RequestURI = ""
+	out.Header = r.Header.Clone()
+	removeHopHeaders(out.Header)
+
+	if webSocket {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+
+	return out
+}
+
+// requestDst returns the address r is sent to: dst, unless a rule moved the
+// request to another host or scheme than the ones of original.
+func requestDst(original, r *http.Request, dst string) string {
+	if dst != "" && (!strings.EqualFold(r.URL.Host, original.URL.Host) || r.URL.Scheme != original.URL.Scheme) {
+		return ""
+	}
+
+	return dst
+}
+
+// toHTTP1 prepares a response, possibly received over HTTP/2, to be written
+// to an HTTP/1.1 client connection.
+func toHTTP1(resp *http.Response) {
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+
+	bodyAllowed := resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		bodyAllowed = false
+	}
+
+	if bodyAllowed && resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+}
+
+func writeBadGateway(w *bufio.Writer) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Close:      true,
+	}
+	resp.Write(w)
+	w.Flush()
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransportDst(t *testing.T) {
+	origins := make([]*httptest.Server, 2)
+	for i := range origins {
+		origins[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "origin %d host %s", i, r.Host)
+		}))
+		t.Cleanup(origins[i].Close)
+	}
+
+	p := Server{dialer: &net.Dialer{}}
+	p.transport = p.newTransport()
+
+	get := func(url, dst string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p.transport.RoundTrip(upstreamRequest(req, dst, nil))
+		if err != nil {
+			t.Fatalf("RoundTrip: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Flows with the same host but different original destinations must
+	// not share pooled connections.
+	for round := 0; round < 2; round++ {
+		for i, srv := range origins {
+			want := fmt.Sprintf("origin %d host origin.test", i)
+			if got := get("http://origin.test/", srv.Listener.Addr().String()); got != want {
+				t.Errorf("round %d: got %q, want %q", round, got, want)
+			}
+		}
+	}
+
+	if got := get(origins[1].URL, ""); got != "origin 1 host "+origins[1].Listener.Addr().String() {
+		t.Errorf("without a destination got %q", got)
+	}
+
+	tr := p.transport.(*dstTransport)
+	if len(tr.byDst) != 2 {
+		t.Fatalf("got %d destination transports, want 2", len(tr.byDst))
+	}
+	for _, e := range tr.byDst {
+		e.used = time.Now().Add(-2 * idleConnTimeout)
+	}
+	tr.forDst("192.0.2.1:80")
+	if len(tr.byDst) != 1 {
+		t.Errorf("idle destination transports were not evicted: %d left", len(tr.byDst))
+	}
+}
+
+func TestRequestDst(t *testing.T) {
+	original, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"http://example.com/other", "10.0.0.1:80"},
+		{"http://EXAMPLE.com/", "10.0.0.1:80"},
+		{"http://staging.example.com/", ""},
+		{"https://example.com/", ""},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		if got := requestDst(original, r, "10.0.0.1:80"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
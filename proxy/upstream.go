@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/eugene-ivanov-hash/mitm-proxy/buf"
+)
+
+// Dialer opens outbound connections to origin servers.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// UpstreamDialer sends outbound connections through an upstream HTTP(S) CONNECT
+// or SOCKS5 proxy, except for hosts matching one of the bypass patterns.
+type UpstreamDialer struct {
+	proxyURL *url.URL
+	bypass   []string
+	direct   *net.Dialer
+}
+
+func NewUpstreamDialer(rawURL string, bypass []string) (*UpstreamDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy url: %v", err)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	u.Host = getHost(u.Host, defaultPort)
+
+	return &UpstreamDialer{
+		proxyURL: u,
+		bypass:   bypass,
+		direct:   &net.Dialer{},
+	}, nil
+}
+
+func (d *UpstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if matchHosts(d.bypass, addr) {
+		return d.direct.DialContext(ctx, network, addr)
+	}
+
+	switch d.proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return d.dialSOCKS5(ctx, network, addr)
+	default:
+		return d.dialConnect(ctx, network, addr)
+	}
+}
+
+func (d *UpstreamDialer) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *xproxy.Auth
+	if d.proxyURL.User != nil {
+		password, _ := d.proxyURL.User.Password()
+		auth = &xproxy.Auth{User: d.proxyURL.User.Username(), Password: password}
+	}
+
+	dialer, err := xproxy.SOCKS5("tcp", d.proxyURL.Host, auth, d.direct)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+func (d *UpstreamDialer) dialConnect(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.direct.DialContext(ctx, network, d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream proxy: %v", err)
+	}
+
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy handshake: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.proxyURL.User != nil {
+		password, _ := d.proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT %s: %s", addr, resp.Status)
+	}
+
+	return buf.NewBufferedConn(conn, br), nil
+}
+
+// matchHosts reports whether the host part of addr matches any of the patterns.
+// A pattern is either a CIDR, a domain with a leading dot matching the domain and
+// all its subdomains, or a glob such as "*.example.com".
+func matchHosts(patterns []string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				continue
+			}
+			if ip := net.ParseIP(host); ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestMatchHosts(t *testing.T) {
+	patterns := []string{"*.internal", ".example.com", "10.0.0.0/8", "localhost"}
+
+	cases := map[string]bool{
+		"api.internal:443":     true,
+		"internal:443":         false,
+		"example.com:443":      true,
+		"www.example.com":      true,
+		"notexample.com:443":   false,
+		"10.1.2.3:80":          true,
+		"11.1.2.3:80":          false,
+		"LOCALHOST:8080":       true,
+		"[::1]:443":            false,
+		"service.internal.com": false,
+	}
+
+	for addr, want := range cases {
+		if got := matchHosts(patterns, addr); got != want {
+			t.Errorf("matchHosts(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestUpstreamDialerConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	gotReq := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		gotReq <- req
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	dialer, err := NewUpstreamDialer("http://user:secret@"+ln.Addr().String(), []string{"localhost"})
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer: %v", err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-gotReq
+	if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+		t.Fatalf("unexpected request %s %s", req.Method, req.Host)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Fatalf("unexpected Proxy-Authorization %q", got)
+	}
+
+	data := make([]byte, 5)
+	if _, err = io.ReadFull(conn, data); err != nil {
+		t.Fatalf("read tunneled data: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected tunneled data %q, got %q", "hello", data)
+	}
+}
@@ -0,0 +1,163 @@
+package rule
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// compileSetHeader sets the headers of the request or response to the
+// values of rule.Headers. Setting Host on a request changes req.Host.
+func compileSetHeader(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	if len(rule.Headers) == 0 {
+		return nil, fmt.Errorf("headers are required")
+	}
+	headers, err := parseHeaders(rule.Headers)
+	if err != nil {
+		return nil, err
+	}
+	response := rule.Change == ChangeTypeEnumResponse
+
+	return func(req *http.Request, resp *http.Response) error {
+		data := templateData{Envs: envs, Request: req, Rule: rule.Name}
+		for name, v := range headers {
+			value, err := v.execute(data)
+			if err != nil {
+				return err
+			}
+			switch {
+			case response:
+				resp.Header.Set(name, value)
+			case name == "Host":
+				req.Host = value
+			default:
+				req.Header.Set(name, value)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// compileRemoveHeader removes the headers in rule.Names from the request or
+// response.
+func compileRemoveHeader(rule *Rule) (func(*http.Request, *http.Response) error, error) {
+	if len(rule.Names) == 0 {
+		return nil, fmt.Errorf("names are required")
+	}
+	names := make([]string, len(rule.Names))
+	for i, name := range rule.Names {
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	response := rule.Change == ChangeTypeEnumResponse
+
+	return func(req *http.Request, resp *http.Response) error {
+		header := req.Header
+		if response {
+			header = resp.Header
+		}
+		for _, name := range names {
+			delete(header, name)
+		}
+		return nil
+	}, nil
+}
+
+// compileRewriteURL sends the request to the absolute URL rule.URL. The Host
+// header follows the new URL.
+func compileRewriteURL(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	target, err := parseURL(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(req *http.Request, _ *http.Response) error {
+		u, err := target(templateData{Envs: envs, Request: req, Rule: rule.Name})
+		if err != nil {
+			return err
+		}
+		req.URL = u
+		req.Host = u.Host
+		return nil
+	}, nil
+}
+
+// compileRedirect answers the request with a redirect to rule.URL, 302
+// Found unless rule.Status is another redirect status.
+func compileRedirect(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	if status < 300 || status > 399 {
+		return nil, fmt.Errorf("invalid redirect status %d", status)
+	}
+	target, err := parseURL(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(req *http.Request, _ *http.Response) error {
+		u, err := target(templateData{Envs: envs, Request: req, Rule: rule.Name})
+		if err != nil {
+			return err
+		}
+		return Respond(NewResponse(req, status, http.Header{"Location": {u.String()}}, ""))
+	}, nil
+}
+
+// compileSetStatus changes the status code of the response.
+func compileSetStatus(rule *Rule) (func(*http.Request, *http.Response) error, error) {
+	if rule.Status < 100 || rule.Status > 999 {
+		return nil, fmt.Errorf("invalid status %d", rule.Status)
+	}
+	status := strconv.Itoa(rule.Status) + " " + http.StatusText(rule.Status)
+
+	return func(_ *http.Request, resp *http.Response) error {
+		resp.StatusCode = rule.Status
+		resp.Status = status
+		return nil
+	}, nil
+}
+
+// parseURL parses the absolute URL template of rule, checking it at
+// compile time when it has no template actions.
+func parseURL(rule *Rule) (func(templateData) (*url.URL, error), error) {
+	if rule.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	v, err := parseValue("url", rule.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	parse := func(s string) (*url.URL, error) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("url %q is not absolute", s)
+		}
+		return u, nil
+	}
+
+	if v.t == nil {
+		u, err := parse(v.static)
+		if err != nil {
+			return nil, err
+		}
+		return func(templateData) (*url.URL, error) {
+			copied := *u
+			return &copied, nil
+		}, nil
+	}
+
+	return func(data templateData) (*url.URL, error) {
+		s, err := v.execute(data)
+		if err != nil {
+			return nil, err
+		}
+		return parse(s)
+	}, nil
+}
@@ -0,0 +1,164 @@
+package rule
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeclarativeActions(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: set request headers
+    enabled: true
+    change: request
+    rule: "true"
+    action: set_header
+    headers:
+      x-env: "{{ .Envs.STAGE }}"
+      Host: api.internal
+  - name: remove request headers
+    enabled: true
+    change: request
+    rule: "true"
+    action: remove_header
+    names: ["cookie", "X-Debug"]
+  - name: rewrite
+    enabled: true
+    change: request
+    rule: "true"
+    action: rewrite_url
+    url: "https://staging.example.com{{ .Request.URL.Path }}?from={{ .Request.Host }}"
+  - name: set response header
+    enabled: true
+    change: response
+    rule: "true"
+    action: set_header
+    headers:
+      Access-Control-Allow-Origin: "*"
+  - name: status
+    enabled: true
+    change: response
+    rule: "true"
+    action: set_status
+    status: 503
+`)
+
+	requestRules, responseRules, err := CompileRules(dir, map[string]string{"STAGE": "qa"})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/v1/items?id=1", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Debug", "1")
+	for _, r := range requestRules {
+		if err = r.Apply(req, nil); err != nil {
+			t.Fatalf("%s: %v", r.Name, err)
+		}
+	}
+	if req.Header.Get("X-Env") != "qa" || req.Header.Get("Cookie") != "" || req.Header.Get("X-Debug") != "" {
+		t.Errorf("unexpected request headers %v", req.Header)
+	}
+	if got := req.URL.String(); got != "https://staging.example.com/v1/items?from=api.internal" || req.Host != "staging.example.com" {
+		t.Errorf("got url %s, host %s", got, req.Host)
+	}
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	for _, r := range responseRules {
+		if err = r.Apply(req, resp); err != nil {
+			t.Fatalf("%s: %v", r.Name, err)
+		}
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.StatusCode != 503 || resp.Status != "503 Service Unavailable" {
+		t.Errorf("unexpected response %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestRedirectAction(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: redirect
+    enabled: true
+    change: request
+    rule: "true"
+    action: redirect
+    status: 301
+    url: "https://new.example.com{{ .Request.URL.RequestURI }}"
+`)
+
+	requestRules, _, err := CompileRules(dir, nil)
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	err = requestRules[0].Apply(httptest.NewRequest("GET", "http://old.example.com/a?b=c", nil), nil)
+	var respond *RespondError
+	if !errors.As(err, &respond) {
+		t.Fatalf("expected a RespondError, got %v", err)
+	}
+	if respond.Response.StatusCode != 301 || respond.Response.Header.Get("Location") != "https://new.example.com/a?b=c" {
+		t.Errorf("unexpected redirect %d %v", respond.Response.StatusCode, respond.Response.Header)
+	}
+}
+
+func TestDeclarativeActionErrors(t *testing.T) {
+	for name, rule := range map[string]string{
+		"missing headers":      "change: request\n    action: set_header",
+		"missing names":        "change: response\n    action: remove_header",
+		"relative url":         "change: request\n    action: rewrite_url\n    url: /path",
+		"bad redirect status":  "change: request\n    action: redirect\n    url: https://example.com\n    status: 200",
+		"set_status request":   "change: request\n    action: set_status\n    status: 500",
+		"rewrite_url response": "change: response\n    action: rewrite_url\n    url: https://example.com",
+	} {
+		dir := writeRules(t, "enabled: true\nrules:\n  - name: bad\n    enabled: true\n    rule: \"true\"\n    "+rule+"\n")
+		if _, _, err := CompileRules(dir, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func benchmarkRule(b *testing.B, rules string) {
+	dir := b.TempDir()
+	writeRulesFile(b, dir, rules)
+	requestRules, _, err := CompileRules(dir, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := requestRules[0].Apply(req, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetHeaderAction(b *testing.B) {
+	benchmarkRule(b, `enabled: true
+rules:
+  - name: set header
+    enabled: true
+    change: request
+    rule: "true"
+    action: set_header
+    headers:
+      X-Env: staging
+`)
+}
+
+func BenchmarkSetHeaderScript(b *testing.B) {
+	benchmarkRule(b, `enabled: true
+rules:
+  - name: set header
+    enabled: true
+    change: request
+    rule: "true"
+    action: script
+    script: |
+      req.Header.Set("X-Env", "staging")
+      return nil
+`)
+}
@@ -0,0 +1,329 @@
+package rule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const grpcFrameHeaderLen = 5
+
+// grpcFiles holds the descriptors used to decode gRPC messages to JSON.
+// Without them messages are exposed as base64 encoded protobuf.
+var grpcFiles *protoregistry.Files
+
+// LoadDescriptorSet loads a FileDescriptorSet, as produced by
+// `protoc --descriptor_set_out --include_imports`, used to decode gRPC
+// messages to JSON.
+func LoadDescriptorSet(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(data, set); err != nil {
+		return fmt.Errorf("failed to parse descriptor set: %v", err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return fmt.Errorf("failed to build descriptors: %v", err)
+	}
+
+	grpcFiles = files
+
+	return nil
+}
+
+// IsGrpc reports whether the headers describe a gRPC message stream.
+func IsGrpc(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// GrpcMessages returns the gRPC messages of the response, or of the request
+// when resp is nil. Messages are JSON when the method is found in the loaded
+// descriptor set and base64 encoded protobuf otherwise.
+func GrpcMessages(req *http.Request, resp *http.Response) ([]string, error) {
+	header, body, method := grpcTarget(req, resp)
+	if !IsGrpc(header) {
+		return nil, fmt.Errorf("not a gRPC message, content type %q", header.Get("Content-Type"))
+	}
+
+	data, err := readBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := decodeGrpcFrames(data, header.Get("Grpc-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		message, err := grpcToJSON(method, resp != nil, frame.data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// SetGrpcMessages replaces the gRPC messages of the response, or of the
+// request when resp is nil. Messages use the format returned by GrpcMessages.
+func SetGrpcMessages(req *http.Request, resp *http.Response, messages []string) error {
+	header, body, method := grpcTarget(req, resp)
+	if !IsGrpc(header) {
+		return fmt.Errorf("not a gRPC message, content type %q", header.Get("Content-Type"))
+	}
+
+	data, err := readBody(body)
+	if err != nil {
+		return err
+	}
+
+	frames, err := decodeGrpcFrames(data, header.Get("Grpc-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	compressed := len(frames) > 0 && frames[0].compressed
+	newFrames := make([]grpcFrame, 0, len(messages))
+	for _, message := range messages {
+		frame, err := grpcFromJSON(method, resp != nil, message)
+		if err != nil {
+			return err
+		}
+		newFrames = append(newFrames, grpcFrame{compressed: compressed, data: frame})
+	}
+
+	newData, err := encodeGrpcFrames(newFrames)
+	if err != nil {
+		return err
+	}
+
+	*body = io.NopCloser(bytes.NewReader(newData))
+	if resp != nil {
+		resp.ContentLength = int64(len(newData))
+	} else {
+		req.ContentLength = int64(len(newData))
+	}
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(newData)))
+	}
+
+	return nil
+}
+
+// GrpcStatus returns the grpc-status code and grpc-message of the response.
+// The status usually arrives in the trailers, so the body is read first.
+func GrpcStatus(resp *http.Response) (int, string, error) {
+	if _, err := readBody(&resp.Body); err != nil {
+		return 0, "", err
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Trailers-only responses carry the status in the headers.
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status == "" {
+		return 0, "", fmt.Errorf("response has no grpc-status")
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid grpc-status %q", status)
+	}
+
+	return code, message, nil
+}
+
+func grpcTarget(req *http.Request, resp *http.Response) (http.Header, *io.ReadCloser, string) {
+	if resp != nil {
+		method := ""
+		if resp.Request != nil {
+			method = resp.Request.URL.Path
+		} else if req != nil {
+			method = req.URL.Path
+		}
+		return resp.Header, &resp.Body, method
+	}
+
+	return req.Header, &req.Body, req.URL.Path
+}
+
+// readBody reads the whole body and leaves it readable for the next reader.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	*body = io.NopCloser(ReusableReader(*body))
+
+	return io.ReadAll(*body)
+}
+
+type grpcFrame struct {
+	compressed bool
+	data       []byte
+}
+
+// decodeGrpcFrames splits a body into length-prefixed gRPC messages,
+// decompressing them according to the grpc-encoding header.
+func decodeGrpcFrames(data []byte, encoding string) ([]grpcFrame, error) {
+	var frames []grpcFrame
+	for len(data) > 0 {
+		if len(data) < grpcFrameHeaderLen {
+			return nil, fmt.Errorf("truncated gRPC frame header")
+		}
+
+		compressed := data[0] == 1
+		length := binary.BigEndian.Uint32(data[1:grpcFrameHeaderLen])
+		data = data[grpcFrameHeaderLen:]
+		if uint32(len(data)) < length {
+			return nil, fmt.Errorf("truncated gRPC frame: want %d bytes, have %d", length, len(data))
+		}
+
+		message := data[:length]
+		data = data[length:]
+
+		if compressed {
+			if encoding != "gzip" {
+				return nil, fmt.Errorf("unsupported grpc-encoding %q", encoding)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(message))
+			if err != nil {
+				return nil, err
+			}
+			message, err = io.ReadAll(zr)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		frames = append(frames, grpcFrame{compressed: compressed, data: message})
+	}
+
+	return frames, nil
+}
+
+func encodeGrpcFrames(frames []grpcFrame) ([]byte, error) {
+	var out bytes.Buffer
+	for _, frame := range frames {
+		message := frame.data
+		flag := byte(0)
+		if frame.compressed {
+			var zbuf bytes.Buffer
+			zw := gzip.NewWriter(&zbuf)
+			if _, err := zw.Write(message); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			message = zbuf.Bytes()
+			flag = 1
+		}
+
+		header := [grpcFrameHeaderLen]byte{flag}
+		binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+		out.Write(header[:])
+		out.Write(message)
+	}
+
+	return out.Bytes(), nil
+}
+
+// grpcMessageDescriptor finds the input or output message type of a method
+// given its path, "/package.Service/Method".
+func grpcMessageDescriptor(method string, output bool) protoreflect.MessageDescriptor {
+	if grpcFiles == nil {
+		return nil
+	}
+
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return nil
+	}
+
+	desc, err := grpcFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+
+	methodDesc := serviceDesc.Methods().ByName(protoreflect.Name(name))
+	if methodDesc == nil {
+		return nil
+	}
+
+	if output {
+		return methodDesc.Output()
+	}
+	return methodDesc.Input()
+}
+
+func grpcToJSON(method string, output bool, data []byte) (string, error) {
+	desc := grpcMessageDescriptor(method, output)
+	if desc == nil {
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", desc.FullName(), err)
+	}
+
+	out, err := protojson.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	// protojson randomizes whitespace, compact it so rules can match on it.
+	var compact bytes.Buffer
+	if err = json.Compact(&compact, out); err != nil {
+		return "", err
+	}
+
+	return compact.String(), nil
+}
+
+func grpcFromJSON(method string, output bool, message string) ([]byte, error) {
+	desc := grpcMessageDescriptor(method, output)
+	if desc == nil {
+		return base64.StdEncoding.DecodeString(message)
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal([]byte(message), msg); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %v", desc.FullName(), err)
+	}
+
+	return proto.Marshal(msg)
+}
@@ -0,0 +1,181 @@
+package rule
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func writeTestDescriptorSet(t *testing.T) string {
+	t.Helper()
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("greeter.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("HelloRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:     proto.String("name"),
+					JsonName: proto.String("name"),
+					Number:   proto.Int32(1),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".test.HelloRequest"),
+				OutputType: proto.String(".test.HelloRequest"),
+			}},
+		}},
+	}
+
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatalf("marshal descriptor set: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "greeter.protoset")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write descriptor set: %v", err)
+	}
+
+	return path
+}
+
+func newGrpcRequest(t *testing.T, path string, frames []grpcFrame) *http.Request {
+	t.Helper()
+
+	body, err := encodeGrpcFrames(frames)
+	if err != nil {
+		t.Fatalf("encodeGrpcFrames: %v", err)
+	}
+
+	return &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "https", Host: "grpc.example.com", Path: path},
+		Header: http.Header{
+			"Content-Type":  []string{"application/grpc"},
+			"Grpc-Encoding": []string{"gzip"},
+		},
+		Body: io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestGrpcMessages(t *testing.T) {
+	if err := LoadDescriptorSet(writeTestDescriptorSet(t)); err != nil {
+		t.Fatalf("LoadDescriptorSet: %v", err)
+	}
+	defer func() { grpcFiles = nil }()
+
+	// field 1, wire type 2, "bob"
+	message := []byte{0x0a, 0x03, 'b', 'o', 'b'}
+	req := newGrpcRequest(t, "/test.Greeter/SayHello", []grpcFrame{
+		{data: message},
+		{compressed: true, data: message},
+	})
+
+	messages, err := GrpcMessages(req, nil)
+	if err != nil {
+		t.Fatalf("GrpcMessages: %v", err)
+	}
+	if len(messages) != 2 || messages[0] != `{"name":"bob"}` || messages[1] != `{"name":"bob"}` {
+		t.Fatalf("unexpected messages %q", messages)
+	}
+
+	if err = SetGrpcMessages(req, nil, []string{`{"name":"alice"}`}); err != nil {
+		t.Fatalf("SetGrpcMessages: %v", err)
+	}
+
+	messages, err = GrpcMessages(req, nil)
+	if err != nil {
+		t.Fatalf("GrpcMessages after set: %v", err)
+	}
+	if len(messages) != 1 || messages[0] != `{"name":"alice"}` {
+		t.Fatalf("unexpected messages after set %q", messages)
+	}
+	if req.ContentLength != 12 {
+		t.Fatalf("expected content length 12, got %d", req.ContentLength)
+	}
+}
+
+func TestGrpcMessagesWithoutDescriptor(t *testing.T) {
+	req := newGrpcRequest(t, "/unknown.Service/Method", []grpcFrame{{data: []byte{0x08, 0x01}}})
+
+	messages, err := GrpcMessages(req, nil)
+	if err != nil {
+		t.Fatalf("GrpcMessages: %v", err)
+	}
+	if len(messages) != 1 || messages[0] != "CAE=" {
+		t.Fatalf("expected base64 message, got %q", messages)
+	}
+}
+
+func TestGrpcStatus(t *testing.T) {
+	resp := &http.Response{
+		Header:  http.Header{"Content-Type": []string{"application/grpc"}},
+		Trailer: http.Header{"Grpc-Status": []string{"5"}, "Grpc-Message": []string{"not found"}},
+		Body:    http.NoBody,
+	}
+
+	code, message, err := GrpcStatus(resp)
+	if err != nil {
+		t.Fatalf("GrpcStatus: %v", err)
+	}
+	if code != 5 || message != "not found" {
+		t.Fatalf("unexpected status %d %q", code, message)
+	}
+}
+
+func TestGrpcScriptAndRule(t *testing.T) {
+	dir := t.TempDir()
+	rules := `enabled: true
+rules:
+  - name: "rename"
+    change: "request"
+    enabled: true
+    rule: "req.isGrpc() && req.grpcMessages().size() == 1"
+    action: "script"
+    import: |
+      "mitm"
+    script: |
+      return mitm.SetGrpcMessages(req, resp, []string{"CAI="})
+`
+	if err := os.WriteFile(filepath.Join(dir, "grpc.yaml"), []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+
+	requestRules, _, err := CompileRules(dir, nil)
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := newGrpcRequest(t, "/unknown.Service/Method", []grpcFrame{{data: []byte{0x08, 0x01}}})
+	ok, err := requestRules[0].Check(req, nil)
+	if err != nil || !ok {
+		t.Fatalf("expected rule to match, got %v %v", ok, err)
+	}
+	if err = requestRules[0].Apply(req, nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	messages, err := GrpcMessages(req, nil)
+	if err != nil {
+		t.Fatalf("GrpcMessages: %v", err)
+	}
+	if len(messages) != 1 || messages[0] != "CAI=" {
+		t.Fatalf("unexpected messages %q", messages)
+	}
+}
@@ -0,0 +1,585 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errPatchTest is returned when a JSON Patch test operation fails.
+var errPatchTest = errors.New("test failed")
+
+// jsonObject is a JSON object that keeps the order of its keys, so edited
+// bodies only differ from the original where they were changed. JSON values
+// are *jsonObject, []any, string, json.Number, bool or nil.
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: make(map[string]any)}
+}
+
+func (o *jsonObject) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) remove(key string) bool {
+	if _, ok := o.values[key]; !ok {
+		return false
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// parseJSON decodes data keeping the order of object keys and the precision
+// of numbers.
+func parseJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: data after the top-level value")
+	}
+
+	return v, nil
+}
+
+func decodeJSON(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := newJSONObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key.(string), v)
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+
+	return tok, nil
+}
+
+// encodeJSON writes v compactly, without escaping HTML characters.
+func encodeJSON(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, k); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, v.values[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		// Encode terminates the value with a newline.
+		buf.Truncate(buf.Len() - 1)
+	}
+
+	return nil
+}
+
+// jsonValue converts a value decoded from a rule file to a JSON value.
+func jsonValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJSON(data)
+}
+
+func copyJSON(v any) any {
+	switch v := v.(type) {
+	case *jsonObject:
+		obj := &jsonObject{keys: append([]string(nil), v.keys...), values: make(map[string]any, len(v.values))}
+		for k, e := range v.values {
+			obj.values[k] = copyJSON(e)
+		}
+		return obj
+	case []any:
+		arr := make([]any, len(v))
+		for i, e := range v {
+			arr[i] = copyJSON(e)
+		}
+		return arr
+	}
+
+	return v
+}
+
+// equalJSON compares JSON values as RFC 6902 test does: numbers by value and
+// objects regardless of the order of their keys.
+func equalJSON(a, b any) bool {
+	switch a := a.(type) {
+	case *jsonObject:
+		b, ok := b.(*jsonObject)
+		if !ok || len(a.values) != len(b.values) {
+			return false
+		}
+		for k, v := range a.values {
+			w, ok := b.values[k]
+			if !ok || !equalJSON(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, xerr := a.Float64()
+		y, yerr := b.Float64()
+		return xerr == nil && yerr == nil && x == y
+	}
+
+	return a == b
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses the token of an array element. With end, "-" is the
+// index after the last element, where add appends.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	last := length - 1
+	if end {
+		last = length
+	}
+	if i > last {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+
+	return i, nil
+}
+
+// getPointer returns the value at the pointer tokens.
+func getPointer(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case *jsonObject:
+			v, ok := node.values[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("can't look up %q in a scalar", t)
+		}
+	}
+
+	return doc, nil
+}
+
+// updatePointer calls fn with the container of the value at tokens and the
+// last token, and returns doc with the container fn returns in its place.
+func updatePointer(doc any, tokens []string, fn func(container any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	child, err := getPointer(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updatePointer(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case *jsonObject:
+		node.values[tokens[0]] = child
+	case []any:
+		i, _ := arrayIndex(tokens[0], len(node), false)
+		node[i] = child
+	}
+
+	return doc, nil
+}
+
+// jsonPatchOp is an RFC 6902 JSON Patch operation.
+type jsonPatchOp struct {
+	op    string
+	path  []string
+	from  []string
+	value any
+}
+
+func compileJSONPatch(op, path, from string, value any) (*jsonPatchOp, error) {
+	p := &jsonPatchOp{op: op}
+	var err error
+	if p.path, err = parsePointer(path); err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "add", "replace", "test":
+		if p.value, err = jsonValue(value); err != nil {
+			return nil, err
+		}
+	case "remove":
+		if len(p.path) == 0 {
+			return nil, fmt.Errorf("can't remove the whole document")
+		}
+	case "move", "copy":
+		if p.from, err = parsePointer(from); err != nil {
+			return nil, err
+		}
+		if op == "move" && len(p.from) == 0 {
+			return nil, fmt.Errorf("can't move the whole document")
+		}
+		if op == "move" && strings.HasPrefix(path+"/", from+"/") && path != from {
+			return nil, fmt.Errorf("can't move %s into itself", from)
+		}
+	default:
+		return nil, fmt.Errorf("unknown JSON patch op %q", op)
+	}
+
+	return p, nil
+}
+
+func (p *jsonPatchOp) apply(doc any) (any, error) {
+	switch p.op {
+	case "add":
+		return addPointer(doc, p.path, copyJSON(p.value))
+	case "remove":
+		return removePointer(doc, p.path)
+	case "replace":
+		if _, err := getPointer(doc, p.path); err != nil {
+			return nil, err
+		}
+		if len(p.path) == 0 {
+			return copyJSON(p.value), nil
+		}
+		return updatePointer(doc, p.path, func(container any, token string) (any, error) {
+			switch c := container.(type) {
+			case *jsonObject:
+				c.values[token] = copyJSON(p.value)
+			case []any:
+				i, _ := arrayIndex(token, len(c), false)
+				c[i] = copyJSON(p.value)
+			}
+			return container, nil
+		})
+	case "move", "copy":
+		v, err := getPointer(doc, p.from)
+		if err != nil {
+			return nil, err
+		}
+		if p.op == "move" {
+			if doc, err = removePointer(doc, p.from); err != nil {
+				return nil, err
+			}
+		} else {
+			v = copyJSON(v)
+		}
+		return addPointer(doc, p.path, v)
+	case "test":
+		v, err := getPointer(doc, p.path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalJSON(v, p.value) {
+			return nil, errPatchTest
+		}
+	}
+
+	return doc, nil
+}
+
+func addPointer(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	return updatePointer(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case *jsonObject:
+			c.set(token, value)
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a scalar", token)
+	})
+}
+
+func removePointer(doc any, tokens []string) (any, error) {
+	return updatePointer(doc, tokens, func(container any, token string) (any, error) {
+		switch c := container.(type) {
+		case *jsonObject:
+			if !c.remove(token) {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %q from a scalar", token)
+	})
+}
+
+// pathSegment is a step of a JSONPath expression: a member name, an array
+// index or a wildcard.
+type pathSegment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the JSONPath subset of dotted and bracketed member
+// names, array indexes, negative ones counting from the end, and wildcards:
+// $.items[0].name, $['user']['e-mail'], $.items[*].price or $.*.
+func parseJSONPath(expr string) ([]pathSegment, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", expr)
+	}
+
+	var segs []pathSegment
+	s := expr[1:]
+	for s != "" {
+		switch {
+		case strings.HasPrefix(s, ".."):
+			return nil, fmt.Errorf("JSONPath %q: recursive descent is not supported", expr)
+		case s[0] == '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("JSONPath %q: empty member name", expr)
+			}
+			segs = append(segs, pathSegment{name: name, wildcard: name == "*"})
+			s = s[end+1:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: missing ]", expr)
+			}
+			inner := s[1:end]
+			switch {
+			case inner == "*":
+				segs = append(segs, pathSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				segs = append(segs, pathSegment{name: inner[1 : len(inner)-1]})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("JSONPath %q: invalid index %q", expr, inner)
+				}
+				segs = append(segs, pathSegment{index: i, isIndex: true})
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", expr, s)
+		}
+	}
+
+	return segs, nil
+}
+
+// resolve returns the array index of seg in an array of length n.
+func (seg pathSegment) resolve(n int) (int, bool) {
+	i := seg.index
+	if i < 0 {
+		i += n
+	}
+
+	return i, i >= 0 && i < n
+}
+
+// walkJSONPath calls last with every container matched by all but the last
+// segment, and returns doc with the containers last returns in their place.
+// Segments that match nothing leave doc unchanged.
+func walkJSONPath(doc any, segs []pathSegment, last func(container any, seg pathSegment) any) any {
+	if len(segs) == 1 {
+		return last(doc, segs[0])
+	}
+
+	seg, rest := segs[0], segs[1:]
+	switch node := doc.(type) {
+	case *jsonObject:
+		for _, k := range node.keys {
+			if seg.wildcard || (!seg.isIndex && k == seg.name) {
+				node.values[k] = walkJSONPath(node.values[k], rest, last)
+			}
+		}
+	case []any:
+		for i := range node {
+			if j, ok := seg.resolve(len(node)); seg.wildcard || (seg.isIndex && ok && i == j) {
+				node[i] = walkJSONPath(node[i], rest, last)
+			}
+		}
+	}
+
+	return doc
+}
+
+// setJSONPath replaces the values matched by segs with copies of value.
+// Missing members named by the last segment are added.
+func setJSONPath(doc any, segs []pathSegment, value any) any {
+	if len(segs) == 0 {
+		return copyJSON(value)
+	}
+
+	return walkJSONPath(doc, segs, func(container any, seg pathSegment) any {
+		switch c := container.(type) {
+		case *jsonObject:
+			if seg.wildcard {
+				for _, k := range c.keys {
+					c.values[k] = copyJSON(value)
+				}
+			} else if !seg.isIndex {
+				c.set(seg.name, copyJSON(value))
+			}
+		case []any:
+			for i := range c {
+				if j, ok := seg.resolve(len(c)); seg.wildcard || (seg.isIndex && ok && i == j) {
+					c[i] = copyJSON(value)
+				}
+			}
+		}
+		return container
+	})
+}
+
+// deleteJSONPath removes the values matched by segs.
+func deleteJSONPath(doc any, segs []pathSegment) any {
+	return walkJSONPath(doc, segs, func(container any, seg pathSegment) any {
+		switch c := container.(type) {
+		case *jsonObject:
+			if seg.wildcard {
+				return newJSONObject()
+			}
+			if !seg.isIndex {
+				c.remove(seg.name)
+			}
+		case []any:
+			if seg.wildcard {
+				return []any{}
+			}
+			if i, ok := seg.resolve(len(c)); seg.isIndex && ok {
+				return append(c[:i], c[i+1:]...)
+			}
+		}
+		return container
+	})
+}
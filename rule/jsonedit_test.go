@@ -0,0 +1,130 @@
+package rule
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, data := range []string{
+		`{"b":1,"a":[true,null,"<&>"],"c":{"z":1.50,"y":12345678901234567890}}`,
+		`[]`,
+		`"text"`,
+	} {
+		doc, err := parseJSON([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		var buf bytes.Buffer
+		if err = encodeJSON(&buf, doc); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != data {
+			t.Errorf("got %s, want %s", buf.String(), data)
+		}
+	}
+
+	if _, err := parseJSON([]byte(`{"a":1} {}`)); err == nil {
+		t.Error("expected an error for trailing data")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// Examples of RFC 6902, appendix A.
+	for _, tc := range []struct {
+		doc, patch, want string
+	}{
+		{`{"foo":"bar"}`, `[{op: add, path: /baz, value: qux}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{op: add, path: /foo/1, value: qux}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{op: remove, path: /baz}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{op: remove, path: /foo/1}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{op: replace, path: /baz, value: boo}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{op: move, from: /foo/waldo, path: /qux/thud}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{op: move, from: /foo/1, path: /foo/3}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{op: test, path: /baz, value: qux}, {op: test, path: /foo/1, value: 2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{op: add, path: /child, value: {grandchild: {}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":["bar"]}`, `[{op: add, path: /foo/-, value: [abc, def]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":0,"m~n":1}`, `[{op: copy, from: /m~0n, path: /a~1b}]`, `{"/":0,"m~n":1,"a/b":1}`},
+		{`{"foo":"bar"}`, `[{op: replace, path: '', value: [1]}]`, `[1]`},
+	} {
+		got, err := applyPatch(t, tc.doc, tc.patch)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.doc, tc.patch, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.doc, tc.patch, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		doc, patch string
+	}{
+		{`{"foo":"bar"}`, `[{op: add, path: /baz/bat, value: qux}]`},
+		{`{"baz":"qux"}`, `[{op: test, path: /baz, value: bar}]`},
+		{`{"foo":["bar"]}`, `[{op: add, path: /foo/2, value: x}]`},
+		{`{"foo":["bar"]}`, `[{op: remove, path: /foo/01}]`},
+		{`{"foo":"bar"}`, `[{op: replace, path: /nope, value: 1}]`},
+	} {
+		if got, err := applyPatch(t, tc.doc, tc.patch); err == nil {
+			t.Errorf("%s %s: expected an error, got %s", tc.doc, tc.patch, got)
+		}
+	}
+
+	if _, err := applyPatch(t, `{"a":1}`, `[{op: test, path: /a, value: 2}]`); !errors.Is(err, errPatchTest) {
+		t.Errorf("expected errPatchTest, got %v", err)
+	}
+}
+
+func applyPatch(t *testing.T, doc, patch string) (string, error) {
+	t.Helper()
+
+	var edits []BodyEdit
+	if err := yaml.Unmarshal([]byte(patch), &edits); err != nil {
+		t.Fatal(err)
+	}
+
+	funcs := make([]bodyEditFunc, len(edits))
+	for i, e := range edits {
+		edit, err := compileBodyEdit(e)
+		if err != nil {
+			t.Fatalf("%s: %v", patch, err)
+		}
+		funcs[i] = edit
+	}
+
+	got, err := editBody([]byte(doc), "", funcs, templateData{})
+	return string(got), err
+}
+
+func TestJSONPath(t *testing.T) {
+	const doc = `{"store":{"book":[{"title":"A","price":8},{"title":"B","price":12}],"open":true},"e-mail":"x"}`
+
+	for _, tc := range []struct {
+		patch, want string
+	}{
+		{`[{set: $.store.open, value: false}]`, `{"store":{"book":[{"title":"A","price":8},{"title":"B","price":12}],"open":false},"e-mail":"x"}`},
+		{`[{set: "$['e-mail']", value: y}]`, `{"store":{"book":[{"title":"A","price":8},{"title":"B","price":12}],"open":true},"e-mail":"y"}`},
+		{`[{set: '$.store.book[*].price', value: 1}]`, `{"store":{"book":[{"title":"A","price":1},{"title":"B","price":1}],"open":true},"e-mail":"x"}`},
+		{`[{set: '$.store.book[-1].isbn', value: "1"}]`, `{"store":{"book":[{"title":"A","price":8},{"title":"B","price":12,"isbn":"1"}],"open":true},"e-mail":"x"}`},
+		{`[{set: '$.missing.deep', value: 1}]`, doc},
+		{`[{delete: '$.store.book[0]'}]`, `{"store":{"book":[{"title":"B","price":12}],"open":true},"e-mail":"x"}`},
+		{`[{delete: '$.store.book[*].price'}, {delete: "$['e-mail']"}]`, `{"store":{"book":[{"title":"A"},{"title":"B"}],"open":true}}`},
+		{`[{delete: '$.store.book[*]'}]`, `{"store":{"book":[],"open":true},"e-mail":"x"}`},
+		{`[{delete: '$.*'}]`, `{}`},
+		{`[{delete: '$.store.book[5]'}]`, doc},
+		{`[{set: '$', value: {replaced: true}}]`, `{"replaced":true}`},
+	} {
+		got, err := applyPatch(t, doc, tc.patch)
+		if err != nil {
+			t.Errorf("%s: %v", tc.patch, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.patch, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package rule
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// localMap answers requests with files on disk, as configured by a map_local
+// rule.
+type localMap struct {
+	path        *valueTemplate
+	stripPrefix string
+	headers     map[string]*valueTemplate
+	envs        map[string]string
+	rule        string
+}
+
+func compileMapLocal(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	if rule.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	m := &localMap{stripPrefix: rule.StripPrefix, envs: envs, rule: rule.Name}
+	var err error
+	if m.path, err = parseValue("path", rule.Path); err != nil {
+		return nil, err
+	}
+	if m.headers, err = parseHeaders(rule.Headers); err != nil {
+		return nil, err
+	}
+
+	return m.respond, nil
+}
+
+// respond answers req with the file it maps to, or 404 Not Found when there
+// is none. Files are read on every request, so changes show up without
+// restarting the proxy.
+func (m *localMap) respond(req *http.Request, _ *http.Response) error {
+	data := templateData{Envs: m.envs, Request: req, Rule: m.rule}
+	name, err := m.path.execute(data)
+	if err != nil {
+		return err
+	}
+
+	f, info, err := m.open(name, req.URL.Path)
+	if err != nil {
+		slog.Debug("Mapped file not found", slog.String("rule", m.rule), slog.String("err", err.Error()))
+		return Respond(NewResponse(req, http.StatusNotFound, http.Header{
+			"Content-Type": {"text/plain; charset=utf-8"},
+		}, "File not found\n"))
+	}
+	defer f.Close()
+
+	w := &fileResponseWriter{header: make(http.Header)}
+	w.header.Set("Cache-Control", "no-cache")
+	for name, v := range m.headers {
+		value, err := v.execute(data)
+		if err != nil {
+			return err
+		}
+		w.header.Set(name, value)
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+
+	resp := NewResponse(req, w.status, w.header, w.body.String())
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		// Responses to HEAD requests have no body but the length of the file.
+		resp.ContentLength = n
+	}
+
+	return Respond(resp)
+}
+
+// open opens the file name. When name is a directory the file is the request
+// path below it, without the strip_prefix of the rule, and index.html for
+// directories.
+func (m *localMap) open(name, urlPath string) (*os.File, os.FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		rel := path.Clean("/" + urlPath)
+		if trimmed, ok := cutPathPrefix(rel, m.stripPrefix); ok {
+			rel = trimmed
+		}
+		name = filepath.Join(name, filepath.FromSlash(rel))
+
+		if info, err = os.Stat(name); err == nil && info.IsDir() {
+			name = filepath.Join(name, "index.html")
+			info, err = os.Stat(name)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+// fileResponseWriter collects the response written by http.ServeContent.
+type fileResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *fileResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fileResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *fileResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
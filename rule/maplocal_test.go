@@ -0,0 +1,153 @@
+package rule
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mapLocal(t *testing.T, r *Rule, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	var respond *RespondError
+	if err := r.Apply(req, nil); !errors.As(err, &respond) {
+		t.Fatalf("expected a RespondError, got %v", err)
+	}
+	body, _ := io.ReadAll(respond.Response.Body)
+
+	return respond.Response, string(body)
+}
+
+func TestMapLocalAction(t *testing.T) {
+	files := t.TempDir()
+	for name, data := range map[string]string{
+		"app.js":            "console.log('local')",
+		"api/users/42.json": `{"id":42}`,
+		"dist/index.html":   "<html></html>",
+		"dist/css/app.css":  "body{}",
+	} {
+		name = filepath.Join(files, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: bundle
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/static/app.min.js'"
+    action: map_local
+    path: "{{ .Envs.FILES }}/app.js"
+  - name: users
+    enabled: true
+    change: request
+    rule: "req.URL.Path.startsWith('/api/')"
+    action: map_local
+    path: "{{ .Envs.FILES }}/api/{{ index .Segments 2 }}/{{ index .Segments 3 }}.json"
+    headers:
+      Access-Control-Allow-Origin: "*"
+  - name: site
+    enabled: true
+    change: request
+    rule: "req.URL.Path.startsWith('/site')"
+    action: map_local
+    path: "{{ .Envs.FILES }}/dist"
+    strip_prefix: /site/
+`)
+
+	requestRules, _, err := CompileRules(dir, map[string]string{"FILES": files})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+	bundle, users, site := requestRules[0], requestRules[1], requestRules[2]
+
+	resp, body := mapLocal(t, bundle, httptest.NewRequest("GET", "https://cdn.example.com/static/app.min.js", nil))
+	if resp.StatusCode != 200 || body != "console.log('local')" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("got content type %q", ct)
+	}
+	if resp.Header.Get("Cache-Control") != "no-cache" || resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+
+	resp, body = mapLocal(t, users, httptest.NewRequest("GET", "https://example.com/api/v1/users/42", nil))
+	if resp.StatusCode != 200 || body != `{"id":42}` || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("missing rule header %v", resp.Header)
+	}
+
+	for path, want := range map[string]string{
+		"/site/":               "<html></html>",
+		"/site/css/app.css":    "body{}",
+		"/site/../../app.js":   "File not found\n",
+		"/site/missing.css":    "File not found\n",
+		"/sitemap/css/app.css": "File not found\n",
+	} {
+		_, body = mapLocal(t, site, httptest.NewRequest("GET", "https://example.com"+path, nil))
+		if body != want {
+			t.Errorf("%s: got %q, want %q", path, body, want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/site/css/app.css", nil)
+	req.Header.Set("Range", "bytes=1-3")
+	resp, body = mapLocal(t, site, req)
+	if resp.StatusCode != http.StatusPartialContent || body != "ody" || resp.Header.Get("Content-Range") != "bytes 1-3/6" {
+		t.Errorf("got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	resp, body = mapLocal(t, site, httptest.NewRequest("HEAD", "https://example.com/site/css/app.css", nil))
+	if resp.StatusCode != 200 || body != "" || resp.ContentLength != 6 {
+		t.Errorf("got %d %q length %d", resp.StatusCode, body, resp.ContentLength)
+	}
+
+	resp, _ = mapLocal(t, users, httptest.NewRequest("GET", "https://example.com/api/v1/users/7", nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for a missing file", resp.StatusCode)
+	}
+}
+
+func TestMapLocalReadsChanges(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(name, []byte("v1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: bundle
+    enabled: true
+    change: request
+    rule: "true"
+    action: map_local
+    path: "{{ .Envs.FILE }}"
+`)
+	requestRules, _, err := CompileRules(dir, map[string]string{"FILE": name})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	if _, body := mapLocal(t, requestRules[0], httptest.NewRequest("GET", "https://example.com/app.js", nil)); body != "v1" {
+		t.Fatalf("got %q", body)
+	}
+	if err := os.WriteFile(name, []byte("v2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := mapLocal(t, requestRules[0], httptest.NewRequest("GET", "https://example.com/app.js", nil)); body != "v2" {
+		t.Errorf("got %q after the file changed", body)
+	}
+}
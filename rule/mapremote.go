@@ -0,0 +1,75 @@
+package rule
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// compileMapRemote sends requests to the origin of rule.URL. The request
+// path, without rule.StripPrefix, is appended to the path of rule.URL and the
+// query is kept. The Host header follows the new origin unless
+// rule.PreserveHost is set.
+func compileMapRemote(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	target, err := parseURL(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	stripPrefix := (&url.URL{Path: rule.StripPrefix}).EscapedPath()
+
+	return func(req *http.Request, _ *http.Response) error {
+		u, err := target(templateData{Envs: envs, Request: req, Rule: rule.Name})
+		if err != nil {
+			return err
+		}
+
+		// The path is joined escaped, so an encoded slash (%2F) stays one.
+		rest := req.URL.EscapedPath()
+		if trimmed, ok := cutPathPrefix(rest, stripPrefix); ok {
+			rest = trimmed
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + rest
+		path, err := url.PathUnescape(rawPath)
+		if err != nil {
+			return err
+		}
+
+		mapped := *req.URL
+		mapped.Scheme = u.Scheme
+		mapped.Host = u.Host
+		mapped.Path = path
+		mapped.RawPath = rawPath
+		if u.RawQuery != "" {
+			mapped.RawQuery = u.RawQuery
+			if req.URL.RawQuery != "" {
+				mapped.RawQuery += "&" + req.URL.RawQuery
+			}
+		}
+
+		req.URL = &mapped
+		if !rule.PreserveHost {
+			req.Host = u.Host
+		}
+		return nil
+	}, nil
+}
+
+// cutPathPrefix returns p without prefix when prefix is a whole number of
+// segments of p, so /api is a prefix of /api/users but not of /apis.
+func cutPathPrefix(p, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return p, false
+	}
+
+	rest, ok := strings.CutPrefix(p, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return p, false
+	}
+
+	return rest, true
+}
@@ -0,0 +1,88 @@
+package rule
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMapRemoteAction(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: dev server
+    enabled: true
+    change: request
+    rule: "req.URL.Host == 'www.example.com'"
+    action: map_remote
+    url: "http://localhost:3000"
+  - name: staging api
+    enabled: true
+    change: request
+    rule: "req.URL.Host == 'api.example.com'"
+    action: map_remote
+    url: "https://{{ .Envs.STAGE }}.example.com/api/?mapped=1"
+    strip_prefix: /v1
+    preserve_host: true
+`)
+
+	requestRules, _, err := CompileRules(dir, map[string]string{"STAGE": "staging"})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url, want, host string
+	}{
+		{"https://www.example.com/app.js?v=2", "http://localhost:3000/app.js?v=2", "localhost:3000"},
+		{"https://www.example.com", "http://localhost:3000/", "localhost:3000"},
+		{"https://api.example.com/v1/users/42?fields=id", "https://staging.example.com/api/users/42?mapped=1&fields=id", "api.example.com"},
+		{"https://api.example.com/v1", "https://staging.example.com/api/?mapped=1", "api.example.com"},
+		{"https://api.example.com/v10/users", "https://staging.example.com/api/v10/users?mapped=1", "api.example.com"},
+		{"https://docs.example.com/v1/", "https://docs.example.com/v1/", "docs.example.com"},
+		{"https://www.example.com/files/a%2Fb%20c.txt", "http://localhost:3000/files/a%2Fb%20c.txt", "localhost:3000"},
+		{"https://api.example.com/v1/repos/org%2Frepo", "https://staging.example.com/api/repos/org%2Frepo?mapped=1", "api.example.com"},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		for _, r := range requestRules {
+			ok, err := r.Check(req, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				continue
+			}
+			if err = r.Apply(req, nil); err != nil {
+				t.Fatalf("%s: %v", r.Name, err)
+			}
+		}
+		if got := req.URL.String(); got != tc.want || req.Host != tc.host {
+			t.Errorf("%s: got %s with host %s, want %s with host %s", tc.url, got, req.Host, tc.want, tc.host)
+		}
+		if got := req.URL.RequestURI(); !strings.HasPrefix(tc.want, req.URL.Scheme+"://"+req.URL.Host+got) {
+			t.Errorf("%s: got request URI %s", tc.url, got)
+		}
+	}
+}
+
+func TestMapRemoteErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"missing url":   "action: map_remote",
+		"relative url":  "action: map_remote\n    url: /api",
+		"response rule": "action: map_remote\n    url: http://localhost:3000",
+	} {
+		change := "request"
+		if name == "response rule" {
+			change = "response"
+		}
+		dir := writeRules(t, `enabled: true
+rules:
+  - name: map
+    enabled: true
+    change: `+change+`
+    rule: "true"
+    `+data+"\n")
+		if _, _, err := CompileRules(dir, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package rule
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// BodyEdit is a change the replace_body action makes to a body. Exactly one
+// of Regex, Literal, Op, Set and Delete is set.
+type BodyEdit struct {
+	// Regex or Literal is replaced with With, a template. With refers to
+	// the groups of Regex as $1 or ${name}.
+	Regex   string `yaml:"regex"`
+	Literal string `yaml:"literal"`
+	With    string `yaml:"with"`
+	// Op, Path, From and Value are an RFC 6902 JSON Patch operation.
+	Op    string `yaml:"op"`
+	Path  string `yaml:"path"`
+	From  string `yaml:"from"`
+	Value any    `yaml:"value"`
+	// Set replaces the values matched by a JSONPath expression with Value,
+	// Delete removes them.
+	Set    string `yaml:"set"`
+	Delete string `yaml:"delete"`
+}
+
+// bodyDoc is a body being edited, as bytes or as a decoded JSON document,
+// converted only when an edit needs the other form.
+type bodyDoc struct {
+	data    []byte
+	doc     any
+	decoded bool
+}
+
+func (b *bodyDoc) bytes() ([]byte, error) {
+	if b.decoded {
+		var buf bytes.Buffer
+		if err := encodeJSON(&buf, b.doc); err != nil {
+			return nil, err
+		}
+		b.data, b.decoded = buf.Bytes(), false
+	}
+
+	return b.data, nil
+}
+
+func (b *bodyDoc) json() (any, error) {
+	if !b.decoded {
+		doc, err := parseJSON(b.data)
+		if err != nil {
+			return nil, fmt.Errorf("body is not JSON: %v", err)
+		}
+		b.doc, b.decoded = doc, true
+	}
+
+	return b.doc, nil
+}
+
+type bodyEditFunc func(body *bodyDoc, data templateData) error
+
+func compileReplaceBody(rule *Rule, envs map[string]string) (func(*http.Request, *http.Response) error, error) {
+	if len(rule.Replace) == 0 {
+		return nil, fmt.Errorf("replace is required")
+	}
+
+	edits := make([]bodyEditFunc, len(rule.Replace))
+	for i, e := range rule.Replace {
+		edit, err := compileBodyEdit(e)
+		if err != nil {
+			return nil, fmt.Errorf("replace %d: %v", i+1, err)
+		}
+		edits[i] = edit
+	}
+	response := rule.Change == ChangeTypeEnumResponse
+
+	return func(req *http.Request, resp *http.Response) error {
+		header, body, contentLength := req.Header, &req.Body, &req.ContentLength
+		if response {
+			header, body, contentLength = resp.Header, &resp.Body, &resp.ContentLength
+		}
+
+		data, err := readBody(body)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+
+		newData, err := editBody(data, header.Get("Content-Encoding"), edits, templateData{Envs: envs, Request: req, Rule: rule.Name})
+		if errors.Is(err, errPatchTest) {
+			// A failing test operation is a condition, not an error: like
+			// a JSON Patch that fails to apply, the body is left unchanged.
+			slog.Debug("Body left unchanged", slog.String("rule", rule.Name), slog.String("err", err.Error()))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		*body = io.NopCloser(bytes.NewReader(newData))
+		*contentLength = int64(len(newData))
+		if header.Get("Content-Length") != "" {
+			header.Set("Content-Length", strconv.Itoa(len(newData)))
+		}
+
+		return nil
+	}, nil
+}
+
+// editBody applies edits to data, decoding and encoding it again with its
+// Content-Encoding.
+func editBody(data []byte, encoding string, edits []bodyEditFunc, tmplData templateData) ([]byte, error) {
+	decoded, err := decodeContent(encoding, data)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bodyDoc{data: decoded}
+	for _, edit := range edits {
+		if err = edit(body, tmplData); err != nil {
+			return nil, err
+		}
+	}
+
+	edited, err := body.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeContent(encoding, edited)
+}
+
+func compileBodyEdit(e BodyEdit) (bodyEditFunc, error) {
+	set := 0
+	for _, v := range []string{e.Regex, e.Literal, e.Op, e.Set, e.Delete} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of regex, literal, op, set and delete is required")
+	}
+
+	switch {
+	case e.Regex != "" || e.Literal != "":
+		return compileTextEdit(e)
+	case e.Op != "":
+		op, err := compileJSONPatch(e.Op, e.Path, e.From, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(body *bodyDoc, _ templateData) error {
+			doc, err := body.json()
+			if err != nil {
+				return err
+			}
+			if body.doc, err = op.apply(doc); err != nil {
+				return fmt.Errorf("%s %s: %w", e.Op, e.Path, err)
+			}
+			return nil
+		}, nil
+	case e.Set != "":
+		segs, err := parseJSONPath(e.Set)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonValue(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(body *bodyDoc, _ templateData) error {
+			doc, err := body.json()
+			if err != nil {
+				return err
+			}
+			body.doc = setJSONPath(doc, segs, value)
+			return nil
+		}, nil
+	}
+
+	segs, err := parseJSONPath(e.Delete)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("can't delete the whole document")
+	}
+	return func(body *bodyDoc, _ templateData) error {
+		doc, err := body.json()
+		if err != nil {
+			return err
+		}
+		body.doc = deleteJSONPath(doc, segs)
+		return nil
+	}, nil
+}
+
+// compileTextEdit replaces the matches of a regular expression or the
+// occurrences of a literal string.
+func compileTextEdit(e BodyEdit) (bodyEditFunc, error) {
+	with, err := parseValue("with", e.With)
+	if err != nil {
+		return nil, err
+	}
+
+	var re *regexp.Regexp
+	if e.Regex != "" {
+		if re, err = regexp.Compile(e.Regex); err != nil {
+			return nil, err
+		}
+	}
+	literal := []byte(e.Literal)
+
+	return func(body *bodyDoc, data templateData) error {
+		replacement, err := with.execute(data)
+		if err != nil {
+			return err
+		}
+		b, err := body.bytes()
+		if err != nil {
+			return err
+		}
+		if re != nil {
+			body.data = re.ReplaceAll(b, []byte(replacement))
+		} else {
+			body.data = bytes.ReplaceAll(b, literal, []byte(replacement))
+		}
+		return nil
+	}, nil
+}
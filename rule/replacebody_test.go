@@ -0,0 +1,203 @@
+package rule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReplaceBodyAction(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: rewrite request
+    enabled: true
+    change: request
+    rule: "true"
+    action: replace_body
+    replace:
+      - regex: '"env":"(\w+)"'
+        with: '"env":"{{ .Envs.STAGE }}","was":"$1"'
+      - literal: "secret"
+        with: "***"
+  - name: patch response
+    enabled: true
+    change: response
+    rule: "true"
+    action: replace_body
+    replace:
+      - op: replace
+        path: /features/checkout
+        value: true
+      - op: add
+        path: /items/-
+        value: {sku: "x<1>", price: 0}
+      - set: $.items[*].price
+        value: 9.99
+      - delete: $.tracking
+      - literal: "9.99"
+        with: "10"
+`)
+
+	requestRules, responseRules, err := CompileRules(dir, map[string]string{"STAGE": "staging"})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "https://example.com/api", strings.NewReader(`{"env":"prod","token":"secret"}`))
+	req.Header.Set("Content-Length", strconv.Itoa(int(req.ContentLength)))
+	if err = requestRules[0].Apply(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if want := `{"env":"staging","was":"prod","token":"***"}`; string(body) != want {
+		t.Errorf("got request body %s, want %s", body, want)
+	}
+	if req.ContentLength != int64(len(body)) || req.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("content length %d, header %q for %d bytes", req.ContentLength, req.Header.Get("Content-Length"), len(body))
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"tracking":{"id":1},"features":{"checkout":false,"search":true},"items":[{"sku":"a","price":1}]}`))
+	zw.Close()
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {strconv.Itoa(gz.Len())}},
+		Body:          io.NopCloser(&gz),
+		ContentLength: int64(gz.Len()),
+	}
+	if err = responseRules[0].Apply(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.ContentLength != int64(len(raw)) || resp.Header.Get("Content-Length") != strconv.Itoa(len(raw)) {
+		t.Errorf("content length %d, header %q for %d bytes", resp.ContentLength, resp.Header.Get("Content-Length"), len(raw))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("response body is no longer gzip: %v", err)
+	}
+	body, _ = io.ReadAll(zr)
+	if want := `{"features":{"checkout":true,"search":true},"items":[{"sku":"a","price":10},{"price":10,"sku":"x<1>"}]}`; string(body) != want {
+		t.Errorf("got response body %s, want %s", body, want)
+	}
+}
+
+func TestReplaceBodyUnchanged(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: patch
+    enabled: true
+    change: response
+    rule: "true"
+    action: replace_body
+    replace:
+      - op: test
+        path: /version
+        value: 2
+      - op: remove
+        path: /debug
+`)
+
+	_, responseRules, err := CompileRules(dir, nil)
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/api", nil)
+	for _, data := range []string{
+		`{"version":1,"debug":true}`,
+		`{"version":1}`,
+	} {
+		resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(data)), ContentLength: int64(len(data))}
+		if err = responseRules[0].Apply(req, resp); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != data || resp.ContentLength != int64(len(data)) {
+			t.Errorf("got %s, want the body unchanged: %s", body, data)
+		}
+	}
+
+	data := `{"version":2.0,"debug":true}`
+	resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(data))}
+	if err = responseRules[0].Apply(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"version":2.0}` {
+		t.Errorf("got %s", body)
+	}
+
+	// Other failures are errors of the rule.
+	for _, data := range []string{
+		`<html>not json</html>`,
+		`{"version":2}`,
+	} {
+		resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(data)), ContentLength: int64(len(data))}
+		if err = responseRules[0].Apply(req, resp); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+
+	resp = &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: io.NopCloser(strings.NewReader("not gzip"))}
+	if err = responseRules[0].Apply(req, resp); err == nil {
+		t.Error("expected an error for a body that fails to decode")
+	}
+}
+
+func TestReplaceBodyErrors(t *testing.T) {
+	for name, replace := range map[string]string{
+		"empty":         "[]",
+		"two edits":     "[{regex: a, literal: b}]",
+		"bad regex":     "[{regex: '('}]",
+		"unknown op":    "[{op: merge, path: /a}]",
+		"bad pointer":   "[{op: remove, path: a}]",
+		"remove root":   "[{op: remove, path: ''}]",
+		"move inside":   "[{op: move, from: /a, path: /a/b}]",
+		"bad jsonpath":  "[{set: items}]",
+		"descent":       "[{delete: $..price}]",
+		"delete root":   "[{delete: $}]",
+		"bad with":      "[{literal: a, with: '{{ .Nope'}]",
+		"bad brackets":  "[{set: '$.items[0'}]",
+		"bad index":     "[{delete: '$.items[x]'}]",
+		"missing delim": "[{set: '$items'}]",
+	} {
+		dir := writeRules(t, `enabled: true
+rules:
+  - name: replace
+    enabled: true
+    change: response
+    rule: "true"
+    action: replace_body
+    replace: `+replace+"\n")
+		if _, _, err := CompileRules(dir, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestContentEncodings(t *testing.T) {
+	data := []byte(strings.Repeat(`{"hello":"world"}`, 10))
+	for _, encoding := range []string{"", "identity", "gzip", "deflate", "br", "zstd"} {
+		encoded, err := encodeContent(encoding, data)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		decoded, err := decodeContent(encoding, encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: got %q", encoding, decoded)
+		}
+	}
+
+	if _, err := decodeContent("compress", data); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
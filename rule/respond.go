@@ -0,0 +1,194 @@
+package rule
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// RespondError makes the proxy send Response to the client. Returned by a
+// request rule, the request is not forwarded upstream; returned by a
+// response rule, it replaces the response of the origin.
+type RespondError struct {
+	Response *http.Response
+}
+
+func (e *RespondError) Error() string {
+	return fmt.Sprintf("responded with status %d", e.Response.StatusCode)
+}
+
+// Respond makes the proxy answer the request with resp. Scripts return it
+// from request rules.
+func Respond(resp *http.Response) error {
+	return &RespondError{Response: resp}
+}
+
+// NewResponse builds a response to req with status, header and body.
+func NewResponse(req *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		StatusCode:    status,
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// templateData is the data of templates executed for a request.
+type templateData struct {
+	Envs    map[string]string
+	Request *http.Request
+	Rule    string
+}
+
+// URL returns the full request URL.
+func (d templateData) URL() string {
+	if d.Request == nil || d.Request.URL == nil {
+		return ""
+	}
+
+	return d.Request.URL.String()
+}
+
+// Segments returns the segments of the cleaned request path, so
+// /static/js/app.js has the segments static, js and app.js.
+func (d templateData) Segments() []string {
+	if d.Request == nil || d.Request.URL == nil {
+		return nil
+	}
+
+	p := strings.Trim(path.Clean("/"+d.Request.URL.Path), "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// valueTemplate is a rule value that may be a template. Values without
+// actions are used as is, without executing a template.
+type valueTemplate struct {
+	static string
+	t      *template.Template
+}
+
+func parseValue(name, value string) (*valueTemplate, error) {
+	if !strings.Contains(value, "{{") {
+		return &valueTemplate{static: value}, nil
+	}
+
+	t, err := template.New(name).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return &valueTemplate{t: t}, nil
+}
+
+func (v *valueTemplate) execute(data templateData) (string, error) {
+	if v.t == nil {
+		return v.static, nil
+	}
+
+	var value strings.Builder
+	if err := v.t.Execute(&value, data); err != nil {
+		return "", fmt.Errorf("%s: %v", v.t.Name(), err)
+	}
+
+	return value.String(), nil
+}
+
+// parseHeaders parses the header values of a rule.
+func parseHeaders(headers map[string]string) (map[string]*valueTemplate, error) {
+	values := make(map[string]*valueTemplate, len(headers))
+	for name, value := range headers {
+		v, err := parseValue("header "+name, value)
+		if err != nil {
+			return nil, err
+		}
+		values[http.CanonicalHeaderKey(name)] = v
+	}
+
+	return values, nil
+}
+
+// responseTemplate is a response configured in a rule file, with headers
+// and body templated per request.
+type responseTemplate struct {
+	status  int
+	headers map[string]*valueTemplate
+	body    *valueTemplate
+	envs    map[string]string
+	rule    string
+}
+
+func compileResponse(rule *Rule, defaultStatus int, defaultBody string, envs map[string]string) (*responseTemplate, error) {
+	rt := &responseTemplate{status: rule.Status, envs: envs, rule: rule.Name}
+	if rt.status == 0 {
+		rt.status = defaultStatus
+	}
+	if rt.status < 100 || rt.status > 999 {
+		return nil, fmt.Errorf("invalid status %d", rt.status)
+	}
+
+	var err error
+	if rt.headers, err = parseHeaders(rule.Headers); err != nil {
+		return nil, err
+	}
+
+	body := rule.Body
+	if body == "" {
+		body = defaultBody
+	}
+	if rt.body, err = parseValue("body", body); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// respond answers req with the response, as the CompiledScript of a rule.
+func (rt *responseTemplate) respond(req *http.Request, _ *http.Response) error {
+	resp, err := rt.response(req)
+	if err != nil {
+		return err
+	}
+
+	return Respond(resp)
+}
+
+// response executes the templates for req.
+func (rt *responseTemplate) response(req *http.Request) (*http.Response, error) {
+	data := templateData{Envs: rt.envs, Request: req, Rule: rt.rule}
+
+	header := make(http.Header, len(rt.headers))
+	for name, v := range rt.headers {
+		value, err := v.execute(data)
+		if err != nil {
+			return nil, err
+		}
+		header.Set(name, value)
+	}
+
+	body, err := rt.body.execute(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Get("Content-Type") == "" && body != "" {
+		header.Set("Content-Type", http.DetectContentType([]byte(body)))
+	}
+
+	return NewResponse(req, rt.status, header, body), nil
+}
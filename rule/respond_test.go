@@ -0,0 +1,140 @@
+package rule
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRules(t *testing.T, data string) string {
+	dir := t.TempDir()
+	writeRulesFile(t, dir, data)
+
+	return dir
+}
+
+func writeRulesFile(t testing.TB, dir, data string) {
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRespondAction(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: stub
+    enabled: true
+    change: request
+    rule: "req.URL.Path == '/stub'"
+    action: respond
+    status: 201
+    headers:
+      X-Method: "{{ .Request.Method }}"
+    body: '{"url":"{{ .URL }}","user":"{{ .Envs.USER }}"}'
+`)
+
+	requestRules, _, err := CompileRules(dir, map[string]string{"USER": "alice"})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "https://example.com/stub", nil)
+	err = requestRules[0].Apply(req, nil)
+
+	var respond *RespondError
+	if !errors.As(err, &respond) {
+		t.Fatalf("expected a RespondError, got %v", err)
+	}
+	resp := respond.Response
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 201 || resp.Header.Get("X-Method") != "POST" {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if want := `{"url":"https://example.com/stub","user":"alice"}`; string(body) != want || resp.ContentLength != int64(len(want)) {
+		t.Errorf("got body %q", body)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("got content type %q", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestRespondScript(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: stub
+    enabled: true
+    change: request
+    rule: "true"
+    action: script
+    import: |
+      "mitm"
+    script: |
+      return mitm.Respond(mitm.NewResponse(req, 418, nil, "teapot"))
+`)
+
+	requestRules, _, err := CompileRules(dir, nil)
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	err = requestRules[0].Apply(httptest.NewRequest("GET", "https://example.com/", nil), nil)
+	var respond *RespondError
+	if !errors.As(err, &respond) || respond.Response.StatusCode != 418 {
+		t.Fatalf("expected a 418 RespondError, got %v", err)
+	}
+}
+
+func TestRespondActionResponseRule(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: stub
+    enabled: true
+    change: response
+    rule: "true"
+    action: respond
+`)
+
+	if _, _, err := CompileRules(dir, nil); err == nil {
+		t.Fatal("expected respond to be rejected for response rules")
+	}
+}
+
+func TestRejectAction(t *testing.T) {
+	dir := writeRules(t, `enabled: true
+rules:
+  - name: block
+    enabled: true
+    change: response
+    rule: "true"
+    action: reject
+  - name: reset
+    enabled: true
+    change: request
+    rule: "true"
+    action: reject
+    reset: true
+`)
+
+	requestRules, responseRules, err := CompileRules(dir, nil)
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	err = responseRules[0].Apply(req, nil)
+	var respond *RespondError
+	if !errors.As(err, &respond) {
+		t.Fatalf("expected a RespondError, got %v", err)
+	}
+	body, _ := io.ReadAll(respond.Response.Body)
+	if respond.Response.StatusCode != 403 || string(body) != "Rejected by rule block\n" {
+		t.Errorf("unexpected response %d %q", respond.Response.StatusCode, body)
+	}
+
+	if err = requestRules[0].Apply(req, nil); !errors.Is(err, ErrReset) {
+		t.Errorf("expected ErrReset, got %v", err)
+	}
+}
@@ -10,15 +10,26 @@ import (
 )
 
 var (
-	rejectedErr = errors.New("rejected by rule")
+	// ErrReset is returned by reject rules with reset set. The proxy resets
+	// the client connection instead of answering.
+	ErrReset = errors.New("connection reset by rule")
 )
 
 type ActionEnum string
 type ChangeTypeEnum string
 
 const (
-	ActionEnumScript ActionEnum = "script"
-	ActionEnumReject ActionEnum = "reject"
+	ActionEnumScript       ActionEnum = "script"
+	ActionEnumReject       ActionEnum = "reject"
+	ActionEnumRespond      ActionEnum = "respond"
+	ActionEnumSetHeader    ActionEnum = "set_header"
+	ActionEnumRemoveHeader ActionEnum = "remove_header"
+	ActionEnumRewriteURL   ActionEnum = "rewrite_url"
+	ActionEnumRedirect     ActionEnum = "redirect"
+	ActionEnumSetStatus    ActionEnum = "set_status"
+	ActionEnumMapLocal     ActionEnum = "map_local"
+	ActionEnumMapRemote    ActionEnum = "map_remote"
+	ActionEnumReplaceBody  ActionEnum = "replace_body"
 )
 
 const (
@@ -26,6 +37,16 @@ const (
 	ChangeTypeEnumResponse ChangeTypeEnum = "response"
 )
 
+// actionChanges restricts actions to request or response rules.
+var actionChanges = map[ActionEnum]ChangeTypeEnum{
+	ActionEnumRespond:    ChangeTypeEnumRequest,
+	ActionEnumRewriteURL: ChangeTypeEnumRequest,
+	ActionEnumRedirect:   ChangeTypeEnumRequest,
+	ActionEnumSetStatus:  ChangeTypeEnumResponse,
+	ActionEnumMapLocal:   ChangeTypeEnumRequest,
+	ActionEnumMapRemote:  ChangeTypeEnumRequest,
+}
+
 type Rule struct {
 	Name           string         `yaml:"name"`
 	Change         ChangeTypeEnum `yaml:"change"`
@@ -36,6 +57,29 @@ type Rule struct {
 	Script         string         `yaml:"script"`
 	CompiledScript func(*http.Request, *http.Response) error
 	CompiledRule   cel.Program
+
+	// Status, Headers and Body configure the response of the respond and
+	// reject actions, Headers the set_header and map_local actions and URL
+	// the rewrite_url, redirect and map_remote actions. Header values, the
+	// body and the URL are templates executed with .Envs, .URL, .Segments,
+	// .Request and .Rule.
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	URL     string            `yaml:"url"`
+	// Names are the headers deleted by the remove_header action.
+	Names []string `yaml:"names"`
+	// Reset makes a reject rule reset the connection instead of answering.
+	Reset bool `yaml:"reset"`
+	// Path is the file or directory template the map_local action serves.
+	// StripPrefix is removed from the request path before map_local looks it
+	// up in a directory or map_remote appends it to URL.
+	Path        string `yaml:"path"`
+	StripPrefix string `yaml:"strip_prefix"`
+	// PreserveHost keeps the Host header of requests moved by map_remote.
+	PreserveHost bool `yaml:"preserve_host"`
+	// Replace are the edits of the replace_body action, applied in order.
+	Replace []BodyEdit `yaml:"replace"`
 }
 
 func (r *Rule) Check(req *http.Request, res *http.Response) (bool, error) {
@@ -58,8 +102,8 @@ func (r *Rule) Check(req *http.Request, res *http.Response) (bool, error) {
 func (r *Rule) Apply(req *http.Request, resp *http.Response) error {
 	slog.Debug("Applying rule", slog.String("rule", r.Name))
 
-	if r.Action == ActionEnumReject {
-		return rejectedErr
+	if r.Action == ActionEnumReject && r.Reset {
+		return ErrReset
 	}
 
 	return r.CompiledScript(req, resp)
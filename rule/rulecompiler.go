@@ -27,6 +27,9 @@ func CompileRules(rulesDir string, envs map[string]string) ([]*Rule, []*Rule, er
 	if err := i.Use(stdlib.Symbols); err != nil {
 		log.Fatalf("failed to use stdlib: %v", err)
 	}
+	if err := i.Use(symbols); err != nil {
+		log.Fatalf("failed to use mitm symbols: %v", err)
+	}
 
 	celEnv, err := NewCelEnv()
 
@@ -80,7 +83,7 @@ func CompileRules(rulesDir string, envs map[string]string) ([]*Rule, []*Rule, er
 				return e(err)
 			}
 
-			err = compileScripts(index, i, r, envs)
+			err = compileAction(index, i, r, envs)
 			if err != nil {
 				return e(err)
 			}
@@ -106,6 +109,22 @@ func CompileRules(rulesDir string, envs map[string]string) ([]*Rule, []*Rule, er
 	return requestRules, responseRules, nil
 }
 
+// NewCondition compiles a standalone CEL expression that can be evaluated
+// with Check.
+func NewCondition(name, expr string, envs map[string]string) (*Rule, error) {
+	celEnv, err := NewCelEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rule{Name: name, Enabled: true, Rule: expr}
+	if err = compileRule(celEnv, r, envs); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
 func compileRule(celEnv *cel.Env, rule *Rule, envs map[string]string) error {
 	t, err := template.New("rule").Parse(rule.Rule)
 	if err != nil {
@@ -148,6 +167,53 @@ func compileRule(celEnv *cel.Env, rule *Rule, envs map[string]string) error {
 	return nil
 }
 
+// compileAction sets the CompiledScript of rule for its action.
+func compileAction(index int, i *interp.Interpreter, rule *Rule, envs map[string]string) error {
+	if change, ok := actionChanges[rule.Action]; ok && rule.Change != change {
+		return fmt.Errorf("rule %s: action %s is only allowed for %s rules", rule.Name, rule.Action, change)
+	}
+
+	var err error
+	switch rule.Action {
+	case ActionEnumRespond:
+		var rt *responseTemplate
+		if rt, err = compileResponse(rule, http.StatusOK, "", envs); err == nil {
+			rule.CompiledScript = rt.respond
+		}
+	case ActionEnumReject:
+		if rule.Reset {
+			return nil
+		}
+		var rt *responseTemplate
+		if rt, err = compileResponse(rule, http.StatusForbidden, "Rejected by rule {{ .Rule }}\n", envs); err == nil {
+			rule.CompiledScript = rt.respond
+		}
+	case ActionEnumSetHeader:
+		rule.CompiledScript, err = compileSetHeader(rule, envs)
+	case ActionEnumRemoveHeader:
+		rule.CompiledScript, err = compileRemoveHeader(rule)
+	case ActionEnumRewriteURL:
+		rule.CompiledScript, err = compileRewriteURL(rule, envs)
+	case ActionEnumRedirect:
+		rule.CompiledScript, err = compileRedirect(rule, envs)
+	case ActionEnumSetStatus:
+		rule.CompiledScript, err = compileSetStatus(rule)
+	case ActionEnumMapLocal:
+		rule.CompiledScript, err = compileMapLocal(rule, envs)
+	case ActionEnumMapRemote:
+		rule.CompiledScript, err = compileMapRemote(rule, envs)
+	case ActionEnumReplaceBody:
+		rule.CompiledScript, err = compileReplaceBody(rule, envs)
+	default:
+		return compileScripts(index, i, rule, envs)
+	}
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", rule.Name, err)
+	}
+
+	return nil
+}
+
 func compileScripts(index int, i *interp.Interpreter, rule *Rule, envs map[string]string) error {
 	packageName := fmt.Sprintf("rule%d", index)
 	t := template.New(packageName)
@@ -266,5 +332,115 @@ func NewCelEnv() (*cel.Env, error) {
 				}),
 			),
 		),
+		cel.Function(
+			"isGrpc",
+			cel.MemberOverload(
+				"req_isGrpc_bool",
+				[]*cel.Type{cel.ObjectType("http.Request")},
+				cel.BoolType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					req, ok := values[0].Value().(*http.Request)
+					if !ok {
+						return types.NewErr("invalid request type")
+					}
+
+					return types.Bool(IsGrpc(req.Header))
+				}),
+			),
+			cel.MemberOverload(
+				"resp_isGrpc_bool",
+				[]*cel.Type{cel.ObjectType("http.Response")},
+				cel.BoolType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					resp, ok := values[0].Value().(*http.Response)
+					if !ok {
+						return types.NewErr("invalid response type")
+					}
+
+					return types.Bool(IsGrpc(resp.Header))
+				}),
+			),
+		),
+		cel.Function(
+			"grpcMessages",
+			cel.MemberOverload(
+				"req_grpcMessages_list",
+				[]*cel.Type{cel.ObjectType("http.Request")},
+				cel.ListType(cel.StringType),
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					req, ok := values[0].Value().(*http.Request)
+					if !ok {
+						return types.NewErr("invalid request type")
+					}
+
+					messages, err := GrpcMessages(req, nil)
+					if err != nil {
+						return types.NewErr("failed to decode gRPC messages: %v", err)
+					}
+
+					return types.NewStringList(types.DefaultTypeAdapter, messages)
+				}),
+			),
+			cel.MemberOverload(
+				"resp_grpcMessages_list",
+				[]*cel.Type{cel.ObjectType("http.Response")},
+				cel.ListType(cel.StringType),
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					resp, ok := values[0].Value().(*http.Response)
+					if !ok {
+						return types.NewErr("invalid response type")
+					}
+
+					messages, err := GrpcMessages(resp.Request, resp)
+					if err != nil {
+						return types.NewErr("failed to decode gRPC messages: %v", err)
+					}
+
+					return types.NewStringList(types.DefaultTypeAdapter, messages)
+				}),
+			),
+		),
+		cel.Function(
+			"grpcStatus",
+			cel.MemberOverload(
+				"resp_grpcStatus_int",
+				[]*cel.Type{cel.ObjectType("http.Response")},
+				cel.IntType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					resp, ok := values[0].Value().(*http.Response)
+					if !ok {
+						return types.NewErr("invalid response type")
+					}
+
+					code, _, err := GrpcStatus(resp)
+					if err != nil {
+						return types.NewErr("failed to read gRPC status: %v", err)
+					}
+
+					return types.Int(code)
+				}),
+			),
+		),
+		cel.Function(
+			"grpcStatusMessage",
+			cel.MemberOverload(
+				"resp_grpcStatusMessage_string",
+				[]*cel.Type{cel.ObjectType("http.Response")},
+				cel.StringType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					resp, ok := values[0].Value().(*http.Response)
+					if !ok {
+						return types.NewErr("invalid response type")
+					}
+
+					_, message, err := GrpcStatus(resp)
+					if err != nil {
+						return types.NewErr("failed to read gRPC status: %v", err)
+					}
+
+					return types.String(message)
+				}),
+			),
+		),
 	)
 }
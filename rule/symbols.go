@@ -0,0 +1,20 @@
+package rule
+
+import (
+	"reflect"
+
+	"github.com/traefik/yaegi/interp"
+)
+
+// symbols exposes helpers to rule scripts as the "mitm" package.
+var symbols = interp.Exports{
+	"mitm/mitm": {
+		"IsGrpc":          reflect.ValueOf(IsGrpc),
+		"GrpcMessages":    reflect.ValueOf(GrpcMessages),
+		"SetGrpcMessages": reflect.ValueOf(SetGrpcMessages),
+		"GrpcStatus":      reflect.ValueOf(GrpcStatus),
+		"Respond":         reflect.ValueOf(Respond),
+		"NewResponse":     reflect.ValueOf(NewResponse),
+		"RespondError":    reflect.ValueOf((*RespondError)(nil)),
+	},
+}